@@ -0,0 +1,220 @@
+package pub
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//	Actions of an ACL rule.
+const (
+	ACL_PUBLISH   = "publish"
+	ACL_SUBSCRIBE = "subscribe"
+	ACL_ALL       = "all"
+
+	//	The identity of a rule that applies to every remote, even to those that
+	//	didn't authenticate.
+	ACL_ANY_IDENTITY = "*"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+//	An ACL grants identities the right to publish to or subscribe to tags. Every
+//	rule consists of an identity, an action and one or more tag patterns:
+//		# identity  action     patterns
+//		billing     publish    invoices.>
+//		billing     subscribe  orders.*.created
+//		*           subscribe  public.>
+//		admin       all        >
+//	Publishing requires a rule whose patterns match the tag, subscribing a rule
+//	whose patterns cover the whole subscription pattern, e.g. "orders.>" covers
+//	"orders.*.created". Everything that no rule grants is denied. Lines starting
+//	with "#" are comments.
+//
+//	An ACL is safe for concurrent use. Reload replaces the rules while the ACL
+//	is in use.
+type ACL struct {
+	filename string
+	rules    []aclRule
+	sync.RWMutex
+}
+
+type aclRule struct {
+	identity  string
+	publish   bool
+	subscribe bool
+	patterns  []string
+}
+
+//	Returns an ACL with the rules read from reader.
+func ParseACL(reader io.Reader) (*ACL, error) {
+	rules, err := parseACLRules(reader)
+	if err != nil {
+		return nil, err
+	}
+	return &ACL{rules: rules}, nil
+}
+
+//	Returns an ACL with the rules of the file. Reload reads the file again.
+func LoadACL(filename string) (*ACL, error) {
+	result := &ACL{filename: filename}
+	err := result.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//	Reads the file of the ACL again and replaces the rules. If the file can't
+//	be read or contains errors, the current rules are kept.
+func (a *ACL) Reload() error {
+	if a.filename == "" {
+		return errors.New("ACL was not loaded from a file")
+	}
+	file, err := os.Open(a.filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	rules, err := parseACLRules(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.filename, err)
+	}
+	a.Lock()
+	defer a.Unlock()
+	a.rules = rules
+	return nil
+}
+
+func parseACLRules(reader io.Reader) ([]aclRule, error) {
+	rules := make([]aclRule, 0)
+	scanner := bufio.NewScanner(reader)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected an identity, an action and at least one pattern", line)
+		}
+		rule := aclRule{identity: fields[0], patterns: fields[2:]}
+		switch fields[1] {
+		case ACL_PUBLISH:
+			rule.publish = true
+		case ACL_SUBSCRIBE:
+			rule.subscribe = true
+		case ACL_ALL:
+			rule.publish, rule.subscribe = true, true
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", line, fields[1])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+//	Returns true if the identity may publish messages with the tag.
+func (a *ACL) CanPublish(identity, tag string) bool {
+	return a.allows(identity, func(rule aclRule, pattern string) bool {
+		return rule.publish && MatchTag(pattern, tag)
+	})
+}
+
+//	Returns true if the identity may subscribe to the tag pattern.
+func (a *ACL) CanSubscribe(identity, pattern string) bool {
+	return a.allows(identity, func(rule aclRule, rulePattern string) bool {
+		return rule.subscribe && coversPattern(rulePattern, pattern)
+	})
+}
+
+func (a *ACL) allows(identity string, grants func(rule aclRule, pattern string) bool) bool {
+	a.RLock()
+	defer a.RUnlock()
+	for _, rule := range a.rules {
+		if rule.identity != ACL_ANY_IDENTITY && rule.identity != identity {
+			continue
+		}
+		for _, pattern := range rule.patterns {
+			if grants(rule, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//	Returns a Publisher that checks every call against the ACL for the given
+//	identity before passing it on to publisher, e.g. to serve a Publisher to an
+//	authenticated remote with ServePublisher. Take the identity from
+//	Peer.AuthenticatedIdentity, as Peer.Identity is chosen by the remote. Denied publishes return
+//	ErrPermissionDenied, denied subscriptions return the new Subscriber closed
+//	without subscribing it. The rules in effect at the time of the call apply,
+//	existing subscriptions are not revoked by a Reload. Close and Drain are
+//	passed on.
+func NewACLPublisher(publisher Publisher, acl *ACL, identity string) Publisher {
+	return &aclPublisher{publisher: publisher, acl: acl, identity: identity}
+}
+
+type aclPublisher struct {
+	publisher Publisher
+	acl       *ACL
+	identity  string
+}
+
+func (a *aclPublisher) Publish(message Message) error {
+	if !a.acl.CanPublish(a.identity, message.Tag()) {
+		return ErrPermissionDenied
+	}
+	return a.publisher.Publish(message)
+}
+
+func (a *aclPublisher) PublishRetained(message Message) error {
+	if !a.acl.CanPublish(a.identity, message.Tag()) {
+		return ErrPermissionDenied
+	}
+	return a.publisher.PublishRetained(message)
+}
+
+func (a *aclPublisher) ClearRetained(tag string) {
+	if a.acl.CanPublish(a.identity, tag) {
+		a.publisher.ClearRetained(tag)
+	}
+}
+
+func (a *aclPublisher) Subscribe(tag string, subCreater func() Subscriber) Subscriber {
+	if !a.acl.CanSubscribe(a.identity, tag) {
+		return deniedSubscriber(subCreater)
+	}
+	return a.publisher.Subscribe(tag, subCreater)
+}
+
+func (a *aclPublisher) SubscribeFrom(tag string, since time.Time, subCreater func() Subscriber) Subscriber {
+	if !a.acl.CanSubscribe(a.identity, tag) {
+		return deniedSubscriber(subCreater)
+	}
+	return a.publisher.SubscribeFrom(tag, since, subCreater)
+}
+
+func deniedSubscriber(subCreater func() Subscriber) Subscriber {
+	result := subCreater()
+	closeSubscriber(result)
+	return result
+}
+
+func (a *aclPublisher) Unsubscribe(tag string, subscriber Subscriber) {
+	a.publisher.Unsubscribe(tag, subscriber)
+}
+
+func (a *aclPublisher) Close() error {
+	return a.publisher.Close()
+}
+
+func (a *aclPublisher) Drain(ctx context.Context) error {
+	return a.publisher.Drain(ctx)
+}
@@ -0,0 +1,143 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("ACL", func() {
+	rules := `
+# identity  action     patterns
+billing     publish    invoices.>
+billing     subscribe  orders.*.created orders.*.paid
+*           subscribe  public.>
+admin       all        >
+`
+
+	var acl *ACL
+
+	BeforeEach(func() {
+		var err error
+		acl, err = ParseACL(strings.NewReader(rules))
+		Expect(err).Should(Succeed())
+	})
+
+	Context("rules", func() {
+		It("should grant publishing to matching tags", func() {
+			Expect(acl.CanPublish("billing", "invoices.eu.paid")).Should(BeTrue())
+			Expect(acl.CanPublish("billing", "orders.eu.created")).Should(BeFalse())
+			Expect(acl.CanPublish("admin", "orders.eu.created")).Should(BeTrue())
+			Expect(acl.CanPublish("", "public.news")).Should(BeFalse())
+		})
+
+		It("should grant subscribing to covered patterns", func() {
+			Expect(acl.CanSubscribe("billing", "orders.eu.created")).Should(BeTrue())
+			Expect(acl.CanSubscribe("billing", "orders.*.paid")).Should(BeTrue())
+			Expect(acl.CanSubscribe("billing", "orders.>")).Should(BeFalse())
+			Expect(acl.CanSubscribe("billing", "invoices.>")).Should(BeFalse())
+			Expect(acl.CanSubscribe("", "public.news")).Should(BeTrue())
+			Expect(acl.CanSubscribe("", ">")).Should(BeFalse())
+			Expect(acl.CanSubscribe("admin", ">")).Should(BeTrue())
+		})
+
+		It("should reject invalid rules", func() {
+			_, err := ParseACL(strings.NewReader("billing publish"))
+			Expect(err).Should(HaveOccurred())
+			_, err = ParseACL(strings.NewReader("billing delete orders.>"))
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("reloading", func() {
+		var filename string
+
+		BeforeEach(func() {
+			dir, err := ioutil.TempDir("", "pub")
+			Expect(err).Should(Succeed())
+			filename = filepath.Join(dir, "acl")
+			Expect(ioutil.WriteFile(filename, []byte("billing publish invoices.>"), 0600)).Should(Succeed())
+			acl, err = LoadACL(filename)
+			Expect(err).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(filepath.Dir(filename))
+		})
+
+		It("should replace the rules", func() {
+			Expect(acl.CanPublish("billing", "orders.eu")).Should(BeFalse())
+			Expect(ioutil.WriteFile(filename, []byte("billing publish orders.>"), 0600)).Should(Succeed())
+			Expect(acl.Reload()).Should(Succeed())
+			Expect(acl.CanPublish("billing", "orders.eu")).Should(BeTrue())
+			Expect(acl.CanPublish("billing", "invoices.eu")).Should(BeFalse())
+		})
+
+		It("should keep the rules if the file is invalid", func() {
+			Expect(ioutil.WriteFile(filename, []byte("billing"), 0600)).Should(Succeed())
+			Expect(acl.Reload()).ShouldNot(Succeed())
+			Expect(acl.CanPublish("billing", "invoices.eu")).Should(BeTrue())
+		})
+	})
+
+	Context("publisher", func() {
+		var broker Publisher
+		var billing Publisher
+
+		BeforeEach(func() {
+			broker = New()
+			billing = NewACLPublisher(broker, acl, "billing")
+		})
+
+		AfterEach(func() {
+			broker.Close()
+		})
+
+		It("should pass on granted calls", func() {
+			sub := billing.Subscribe("orders.*.created", NewSubscriber)
+			Expect(billing.Publish(NewMessage("invoices.eu"))).Should(Succeed())
+			Expect(broker.Publish(NewMessage("orders.eu.created"))).Should(Succeed())
+			Expect(sub.WaitForMessage().Tag()).Should(Equal("orders.eu.created"))
+		})
+
+		It("should deny publishing", func() {
+			sub := broker.Subscribe("orders.>", NewSubscriber).(ContextSubscriber)
+			Expect(billing.Publish(NewMessage("orders.eu.created"))).Should(Equal(ErrPermissionDenied))
+			Expect(billing.PublishRetained(NewMessage("orders.eu.created"))).Should(Equal(ErrPermissionDenied))
+			Consistently(func() error {
+				_, err := sub.TryWaitForMessage()
+				return err
+			}).Should(Equal(ErrNoMessage))
+		})
+
+		It("should deny subscribing", func() {
+			sub := billing.Subscribe("orders.>", NewSubscriber)
+			broker.Publish(NewMessage("orders.eu.created"))
+			Expect(sub.WaitForMessage()).Should(BeNil())
+		})
+
+		It("should be enforced for remotes", func() {
+			client, server := loopbackPair()
+			served := make(chan error, 1)
+			serverConn := NewBinaryConnection(server)
+			go func() {
+				served <- ServePublisher(serverConn, billing)
+				serverConn.Close()
+			}()
+			remote := NewRemotePublisher(NewBinaryConnection(client))
+
+			allowed := broker.Subscribe("invoices.>", NewChanSubscriber).(ChanSubscriber)
+			denied := broker.Subscribe("orders.>", NewChanSubscriber).(ChanSubscriber)
+			remote.Publish(NewMessage("orders.eu.created"))
+			remote.Publish(NewMessage("invoices.eu"))
+			Eventually(allowed.Messages()).Should(Receive())
+			Expect(denied.Messages()).ShouldNot(Receive())
+
+			remote.Close()
+			Eventually(served).Should(Receive())
+		})
+	})
+})
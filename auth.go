@@ -0,0 +1,175 @@
+package pub
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+)
+
+//	The tag of the messages that report rejected connections to the Publisher
+//	given to ListenOn. The payload is the reason, the headers tell who was
+//	rejected. Remotes can't register a connection ID with this tag, see
+//	RESERVED_ID_PREFIX.
+const AUTH_FAILURE_TAG = "pub/auth/failure"
+
+//	Headers of the messages tagged with AUTH_FAILURE_TAG.
+const (
+	AUTH_ADDRESS_HEADER  = "pub-remote-address"
+	AUTH_IDENTITY_HEADER = "pub-identity"
+)
+
+//	The methods of the included Authenticators, as advertised in the greeting.
+const (
+	AUTH_METHOD_SHARED_SECRET = "shared-secret"
+	AUTH_METHOD_TOKEN         = "token"
+	AUTH_METHOD_CERTIFICATE   = "certificate"
+)
+
+//	Strings sent by the listening side once the authentication is done.
+const (
+	AUTH_OK     = "AUTH OK"
+	AUTH_DENIED = "AUTH DENIED"
+)
+
+var ErrAuthenticationFailed = errors.New("authentication failed")
+
+//	An Authenticator decides whether a remote may register with a Messenger.
+//	It runs right after the greeting: the talking side calls Prove, the
+//	listening side Verify, so both sides must use matching Authenticators.
+//	Both sides advertise the Method in the greeting, and TalkOn fails right
+//	away if the methods don't match.
+//	Remotes that fail are closed before their connection ID is read, so they
+//	never show up in StartConversation or AwaitConversation.
+type Authenticator interface {
+	//	The name of the authentication method, e.g. AUTH_METHOD_TOKEN.
+	Method() string
+
+	//	Proves the identity of the talking side. The identity is the one from
+	//	MessengerConfig.Identity.
+	Prove(conn Connection, identity string) error
+
+	//	Verifies the remote on the listening side and returns its
+	//	authenticated identity.
+	Verify(conn Connection) (string, error)
+}
+
+//	Returns an Authenticator for a secret that both sides share. The listening
+//	side sends a random challenge, which the talking side answers with the
+//	HMAC-SHA256 of the challenge and its identity. The secret itself is never
+//	sent. The authenticated identity is the one of the greeting.
+func NewSharedSecretAuthenticator(secret []byte) Authenticator {
+	return &sharedSecretAuthenticator{secret: secret}
+}
+
+type sharedSecretAuthenticator struct {
+	secret []byte
+}
+
+func (s *sharedSecretAuthenticator) Method() string {
+	return AUTH_METHOD_SHARED_SECRET
+}
+
+func (s *sharedSecretAuthenticator) Prove(conn Connection, identity string) error {
+	challenge, err := conn.ReceiveString()
+	if err != nil {
+		return err
+	}
+	return conn.SendString(s.sign(challenge, identity))
+}
+
+func (s *sharedSecretAuthenticator) Verify(conn Connection) (string, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	challenge := hex.EncodeToString(nonce)
+	err = conn.SendString(challenge)
+	if err != nil {
+		return "", err
+	}
+	response, err := conn.ReceiveString()
+	if err != nil {
+		return "", err
+	}
+	identity := conn.Peer().Identity
+	if !hmac.Equal([]byte(response), []byte(s.sign(challenge, identity))) {
+		return "", ErrAuthenticationFailed
+	}
+	return identity, nil
+}
+
+func (s *sharedSecretAuthenticator) sign(challenge, identity string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(challenge))
+	mac.Write([]byte{0})
+	mac.Write([]byte(identity))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//	Returns an Authenticator for bearer tokens. The talking side sends token,
+//	the listening side looks up the identity of the received token in
+//	identities. Tokens are sent as they are, so they should only be used over
+//	TLS.
+func NewTokenAuthenticator(token string, identities map[string]string) Authenticator {
+	return &tokenAuthenticator{token: token, identities: identities}
+}
+
+type tokenAuthenticator struct {
+	token      string
+	identities map[string]string
+}
+
+func (t *tokenAuthenticator) Method() string {
+	return AUTH_METHOD_TOKEN
+}
+
+func (t *tokenAuthenticator) Prove(conn Connection, identity string) error {
+	return conn.SendString(t.token)
+}
+
+func (t *tokenAuthenticator) Verify(conn Connection) (string, error) {
+	token, err := conn.ReceiveString()
+	if err != nil {
+		return "", err
+	}
+	var result string
+	found := false
+	for known, identity := range t.identities {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(known)) == 1 {
+			result, found = identity, true
+		}
+	}
+	if !found {
+		return "", ErrAuthenticationFailed
+	}
+	return result, nil
+}
+
+//	Returns an Authenticator that accepts remotes with a verified TLS client
+//	certificate, see MessengerConfig.TLS. The authenticated identity is the
+//	common name of the certificate. Nothing is exchanged.
+func NewCertificateAuthenticator() Authenticator {
+	return certificateAuthenticator{}
+}
+
+type certificateAuthenticator struct{}
+
+func (c certificateAuthenticator) Method() string {
+	return AUTH_METHOD_CERTIFICATE
+}
+
+func (c certificateAuthenticator) Prove(conn Connection, identity string) error {
+	return nil
+}
+
+func (c certificateAuthenticator) Verify(conn Connection) (string, error) {
+	peer := conn.Peer()
+	if peer.TLS == nil || len(peer.TLS.VerifiedChains) == 0 {
+		return "", errors.New("no verified client certificate")
+	}
+	return peer.Certificate().Subject.CommonName, nil
+}
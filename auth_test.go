@@ -0,0 +1,227 @@
+package pub
+
+import (
+	"context"
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+var _ = Describe("Authenticator", func() {
+	var server Messenger
+	var notifications Publisher
+	var failures ChanSubscriber
+	var address string
+
+	listen := func(config MessengerConfig) {
+		address = "127.0.0.1:" + strconv.Itoa(int(rand.Int31n(100))+9600)
+		notifications = New()
+		failures = notifications.Subscribe(AUTH_FAILURE_TAG, NewChanSubscriber).(ChanSubscriber)
+		server = NewMessengerWithConfig(config)
+		_, err := server.ListenOn("tcp", address, notifications)
+		Expect(err).Should(Succeed())
+	}
+
+	AfterEach(func() {
+		server.StopListening()
+	})
+
+	register := func(config MessengerConfig, connId string) (Connection, error) {
+		clientConn, err := NewMessengerWithConfig(config).TalkTo(address)
+		if err != nil {
+			return nil, err
+		}
+		Expect(clientConn.SendString(connId)).Should(Succeed())
+		return clientConn, nil
+	}
+
+	awaitConversation := func(connId string) Connection {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result, err := server.AwaitConversation(ctx, connId)
+		Expect(err).Should(Succeed())
+		return result
+	}
+
+	expectFailure := func(identity string) {
+		var failure Message
+		Eventually(failures.Messages()).Should(Receive(&failure))
+		Expect(failure.Header(AUTH_IDENTITY_HEADER)).Should(Equal(identity))
+		Expect(failure.Header(AUTH_ADDRESS_HEADER)).ShouldNot(BeEmpty())
+	}
+
+	Context("shared secret", func() {
+		BeforeEach(func() {
+			listen(MessengerConfig{Authenticator: NewSharedSecretAuthenticator([]byte("secret"))})
+		})
+
+		It("should accept remotes that know the secret", func() {
+			clientConn, err := register(MessengerConfig{
+				Identity:      "node-1",
+				Authenticator: NewSharedSecretAuthenticator([]byte("secret")),
+			}, "known")
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+
+			serverConn := awaitConversation("known")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Authenticated).Should(BeTrue())
+			Expect(serverConn.Peer().Identity).Should(Equal("node-1"))
+			Expect(serverConn.Peer().AuthenticatedIdentity()).Should(Equal("node-1"))
+		})
+
+		It("should not vouch for the claimed identity of others", func() {
+			Expect(Peer{Identity: "node-1"}.AuthenticatedIdentity()).Should(BeEmpty())
+		})
+
+		It("should reject remotes with another secret", func() {
+			_, err := register(MessengerConfig{
+				Identity:      "intruder",
+				Authenticator: NewSharedSecretAuthenticator([]byte("guess")),
+			}, "unknown")
+			Expect(err).Should(Equal(ErrAuthenticationFailed))
+			expectFailure("intruder")
+			_, ok := server.StartConversation("unknown")
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should reject legacy clients", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).Should(Succeed())
+			legacyConn := NewConnection(conn)
+			defer legacyConn.Close()
+			Expect(legacyConn.SendString("legacy")).Should(Succeed())
+
+			expectFailure("")
+			_, err = legacyConn.ReceiveString()
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("bearer token", func() {
+		BeforeEach(func() {
+			listen(MessengerConfig{Authenticator: NewTokenAuthenticator("", map[string]string{"token-1": "service-1"})})
+		})
+
+		It("should accept known tokens", func() {
+			clientConn, err := register(MessengerConfig{
+				Identity:      "claimed",
+				Authenticator: NewTokenAuthenticator("token-1", nil),
+			}, "token")
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+
+			serverConn := awaitConversation("token")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Identity).Should(Equal("service-1"))
+		})
+
+		It("should publish as the authenticated identity", func() {
+			clientConn, err := register(MessengerConfig{
+				Identity:      "claimed",
+				Authenticator: NewTokenAuthenticator("token-1", nil),
+			}, "sender")
+			Expect(err).Should(Succeed())
+			serverConn := awaitConversation("sender")
+			broker := New()
+			defer broker.Close()
+			sub := broker.Subscribe("news", NewSubscriber)
+			served := make(chan error, 1)
+			go func() {
+				served <- ServePublisher(serverConn, broker)
+				serverConn.Close()
+			}()
+
+			remote := NewRemotePublisher(clientConn)
+			message := NewMessage("news")
+			message.SetSender("forged")
+			Expect(remote.Publish(message)).Should(Succeed())
+			Expect(sub.WaitForMessage().Sender()).Should(Equal("service-1"))
+			remote.Close()
+			Eventually(served).Should(Receive())
+		})
+
+		It("should reject unknown tokens", func() {
+			_, err := register(MessengerConfig{
+				Identity:      "claimed",
+				Authenticator: NewTokenAuthenticator("token-2", nil),
+			}, "token")
+			Expect(err).Should(Equal(ErrAuthenticationFailed))
+			expectFailure("claimed")
+		})
+	})
+
+	Context("mismatched methods", func() {
+		BeforeEach(func() {
+			listen(MessengerConfig{Authenticator: NewTokenAuthenticator("", map[string]string{"token-1": "service-1"})})
+		})
+
+		It("should fail clients with another method", func() {
+			_, err := NewMessengerWithConfig(MessengerConfig{
+				Authenticator: NewSharedSecretAuthenticator([]byte("secret")),
+			}).TalkTo(address)
+			Expect(err).Should(MatchError(`remote requires "token" authentication, but the Authenticator uses "shared-secret"`))
+		})
+
+		It("should fail clients without an Authenticator", func() {
+			_, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(MatchError(`remote requires "token" authentication, but no Authenticator is configured`))
+		})
+
+		It("should fail clients that authenticate at a remote that doesn't", func() {
+			server.StopListening()
+			listen(MessengerConfig{})
+			_, err := NewMessengerWithConfig(MessengerConfig{
+				Authenticator: NewTokenAuthenticator("token-1", nil),
+			}).TalkTo(address)
+			Expect(err).Should(MatchError(`remote doesn't accept authentication, but the Authenticator uses "token"`))
+		})
+	})
+
+	Context("client certificate", func() {
+		var certificates testCertificates
+
+		BeforeEach(func() {
+			certificates = newTestCertificates()
+			listen(MessengerConfig{
+				Authenticator: NewCertificateAuthenticator(),
+				TLS: &tls.Config{
+					Certificates: []tls.Certificate{certificates.server},
+					ClientAuth:   tls.VerifyClientCertIfGiven,
+					ClientCAs:    certificates.pool,
+				},
+			})
+		})
+
+		It("should accept verified certificates", func() {
+			clientConn, err := register(MessengerConfig{
+				Authenticator: NewCertificateAuthenticator(),
+				TLS: &tls.Config{
+					RootCAs:      certificates.pool,
+					Certificates: []tls.Certificate{certificates.client},
+				},
+			}, "certificate")
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+
+			serverConn := awaitConversation("certificate")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Authenticated).Should(BeTrue())
+			Expect(serverConn.Peer().Identity).Should(Equal("client"))
+		})
+
+		It("should reject remotes without certificate", func() {
+			_, err := register(MessengerConfig{
+				Identity:      "anonymous",
+				Authenticator: NewCertificateAuthenticator(),
+				TLS:           &tls.Config{RootCAs: certificates.pool},
+			}, "anonymous")
+			Expect(err).Should(Equal(ErrAuthenticationFailed))
+			expectFailure("anonymous")
+		})
+	})
+})
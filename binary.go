@@ -0,0 +1,440 @@
+package pub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+//	Frame types of the binary protocol.
+const (
+	FRAME_MESSAGE      = 1
+	FRAME_STRING       = 2
+	FRAME_FILE_START   = 3
+	FRAME_FILE_CHUNK   = 4
+	FRAME_FILE_END     = 5
+	FRAME_STREAM_START = 6
+	FRAME_STREAM_DATA  = 7
+	FRAME_STREAM_END   = 8
+)
+
+const (
+	FRAME_HEADER_SIZE = 5
+	MAX_FRAME_SIZE    = 16 << 20
+	FILE_CHUNK_SIZE   = 32 << 10
+)
+
+//	Converts the given connection into a Connection that uses the binary
+//	protocol. Every item is sent as a frame: one byte frame type, the length of
+//	the body as 4 byte big endian integer and the body itself. Unlike the
+//	line-based protocol of NewConnection, all items round-trip arbitrary bytes
+//	exactly: no "\n" is added or escaped and there is no line length limit.
+//	Files and stream data are sent in chunks, the body of a message or string
+//	must not exceed MAX_FRAME_SIZE.
+//
+//	The body of a message frame consists of the tag, ID, sender, timestamp
+//	(Unix nanoseconds, 0 if not set), the number of headers and every header
+//	key and value, followed by the payload. Strings are prefixed with their
+//	length, numbers are encoded as uvarint.
+func NewBinaryConnection(conn net.Conn) Connection {
+	return newBinaryConnection(conn, bufio.NewReader(conn), Peer{})
+}
+
+func newBinaryConnection(conn net.Conn, reader *bufio.Reader, peer Peer) *binaryConnection {
+	return &binaryConnection{
+		conn:       conn,
+		reader:     reader,
+		writer:     bufio.NewWriter(conn),
+		readBuffer: bytes.NewBuffer(make([]byte, 0)),
+		peer:       peer,
+	}
+}
+
+type binaryConnection struct {
+	conn        net.Conn
+	peer        Peer
+	reader      *bufio.Reader
+	writer      *bufio.Writer
+	readBuffer  *bytes.Buffer
+	isStreaming bool
+	liveness
+	writeLock sync.Mutex
+}
+
+//	Writes a single frame. Frames are written one at a time, so that pongs can
+//	be sent while the Connection is in use.
+func (b *binaryConnection) writeFrame(frameType byte, body []byte) error {
+	b.writeLock.Lock()
+	defer b.writeLock.Unlock()
+	if len(body) > MAX_FRAME_SIZE {
+		return errors.New("frame exceeds the maximum frame size")
+	}
+	header := make([]byte, FRAME_HEADER_SIZE)
+	header[0] = frameType
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)))
+	_, err := b.writer.Write(header)
+	if err != nil {
+		return err
+	}
+	_, err = b.writer.Write(body)
+	if err != nil {
+		return err
+	}
+	return b.writer.Flush()
+}
+
+//	Reads the next frame. Heartbeats are answered and skipped.
+func (b *binaryConnection) readFrame() (byte, []byte, error) {
+	for {
+		frameType, body, err := b.readSingleFrame()
+		if err != nil {
+			return frameType, body, err
+		}
+		b.markSeen()
+		switch frameType {
+		case FRAME_PING:
+			err = b.writeFrame(FRAME_PONG, nil)
+			if err != nil {
+				return frameType, body, err
+			}
+		case FRAME_PONG:
+		default:
+			return frameType, body, nil
+		}
+	}
+}
+
+func (b *binaryConnection) readSingleFrame() (byte, []byte, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(b.reader, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[1:])
+	if length > MAX_FRAME_SIZE {
+		return 0, nil, errors.New("frame exceeds the maximum frame size")
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(b.reader, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return header[0], body, nil
+}
+
+//	Reads the next frame and returns an error if it is not of the expected type.
+func (b *binaryConnection) readFrameOfType(frameType byte) ([]byte, error) {
+	receivedType, body, err := b.readFrame()
+	if err != nil {
+		return nil, err
+	}
+	if receivedType != frameType {
+		return nil, errors.New("received an unexpected frame")
+	}
+	return body, nil
+}
+
+func (b *binaryConnection) SendMessage(message Message) error {
+	if b.isStreaming {
+		return errors.New("can't send message when streaming")
+	}
+	message.Close()
+	payload, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	return b.writeFrame(FRAME_MESSAGE, encodeMessage(message, payload))
+}
+
+func (b *binaryConnection) SendString(message string) error {
+	if b.isStreaming {
+		return errors.New("can't send string when streaming")
+	}
+	return b.writeFrame(FRAME_STRING, []byte(message))
+}
+
+func (b *binaryConnection) SendAndCloseFile(file *os.File) error {
+	if b.isStreaming {
+		return errors.New("can't send file when streaming")
+	}
+	defer file.Close()
+	err := b.writeFrame(FRAME_FILE_START, nil)
+	if err != nil {
+		return err
+	}
+	chunk := make([]byte, FILE_CHUNK_SIZE)
+	for {
+		n, err := file.Read(chunk)
+		if n > 0 {
+			writeErr := b.writeFrame(FRAME_FILE_CHUNK, chunk[:n])
+			if writeErr != nil {
+				return writeErr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return b.writeFrame(FRAME_FILE_END, nil)
+}
+
+func (b *binaryConnection) ReceiveMessageWithTag(tag string) (Message, error) {
+	message, err := b.ReceiveMessage()
+	if err != nil {
+		return message, err
+	}
+	if message.Tag() != tag {
+		return nil, errors.New("the received tag didn't match the expected tag")
+	}
+	return message, nil
+}
+
+func (b *binaryConnection) ReceiveMessage() (Message, error) {
+	if b.isStreaming {
+		return nil, errors.New("can't receive message when streaming")
+	}
+	body, err := b.readFrameOfType(FRAME_MESSAGE)
+	if err != nil {
+		return nil, err
+	}
+	return decodeMessage(body)
+}
+
+func (b *binaryConnection) ReceiveString() (string, error) {
+	if b.isStreaming {
+		return "", errors.New("can't receive string when streaming")
+	}
+	body, err := b.readFrameOfType(FRAME_STRING)
+	return string(body), err
+}
+
+func (b *binaryConnection) ReceiveFile(filename string) (*os.File, error) {
+	if b.isStreaming {
+		return nil, errors.New("can't receive file when streaming")
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, err = b.readFrameOfType(FRAME_FILE_START)
+	if err != nil {
+		return file, errors.New("no file start frame found")
+	}
+	for {
+		frameType, body, err := b.readFrame()
+		if err != nil {
+			return file, err
+		}
+		switch frameType {
+		case FRAME_FILE_CHUNK:
+			_, err = file.Write(body)
+			if err != nil {
+				return file, err
+			}
+		case FRAME_FILE_END:
+			file.Sync()
+			file.Seek(0, 0)
+			return file, nil
+		default:
+			return file, errors.New("no valid file chunk received")
+		}
+	}
+}
+
+func (b *binaryConnection) StartStream() error {
+	if b.isStreaming {
+		return nil
+	}
+	b.isStreaming = true
+	err := b.writeFrame(FRAME_STREAM_START, nil)
+	if err != nil {
+		return err
+	}
+	_, err = b.readFrameOfType(FRAME_STREAM_START)
+	return err
+}
+
+func (b *binaryConnection) StopStream() error {
+	if !b.isStreaming {
+		return nil
+	}
+	b.isStreaming = false
+	return b.writeFrame(FRAME_STREAM_END, nil)
+}
+
+//	Every call to Write sends p as a single frame, or as several frames if p
+//	exceeds MAX_FRAME_SIZE. p is not modified.
+func (b *binaryConnection) Write(p []byte) (int, error) {
+	if !b.isStreaming {
+		return 0, nil
+	}
+	written := 0
+	for {
+		chunk := p[written:]
+		if len(chunk) > MAX_FRAME_SIZE {
+			chunk = chunk[:MAX_FRAME_SIZE]
+		}
+		err := b.writeFrame(FRAME_STREAM_DATA, chunk)
+		if err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		if written == len(p) {
+			return written, nil
+		}
+	}
+}
+
+//	Read fills p with the data of one or more frames. Data that doesn't fit into
+//	p is kept for the next call. Returns io.EOF once the remote stopped the stream.
+func (b *binaryConnection) Read(p []byte) (int, error) {
+	if !b.isStreaming {
+		return 0, nil
+	}
+	n, _ := b.readBuffer.Read(p)
+	for n < len(p) {
+		if n > 0 && b.reader.Buffered() == 0 {
+			return n, nil
+		}
+		frameType, body, err := b.readFrame()
+		if err != nil {
+			return n, err
+		}
+		switch frameType {
+		case FRAME_STREAM_DATA:
+			copied := copy(p[n:], body)
+			n += copied
+			b.readBuffer.Write(body[copied:])
+		case FRAME_STREAM_END:
+			b.isStreaming = false
+			return n, io.EOF
+		default:
+			return n, errors.New("received an unexpected frame while streaming")
+		}
+	}
+	return n, nil
+}
+
+func (b *binaryConnection) Peer() Peer {
+	return b.peer
+}
+
+func (b *binaryConnection) setPeer(peer Peer) {
+	b.peer = peer
+}
+
+func (b *binaryConnection) SetDeadline(t time.Time) error {
+	return b.conn.SetDeadline(t)
+}
+
+func (b *binaryConnection) SetReadDeadline(t time.Time) error {
+	return b.conn.SetReadDeadline(t)
+}
+
+func (b *binaryConnection) SetWriteDeadline(t time.Time) error {
+	return b.conn.SetWriteDeadline(t)
+}
+
+func (b *binaryConnection) Close() error {
+	b.markClosed()
+	return b.conn.Close()
+}
+
+func (b *binaryConnection) ping() error {
+	return b.writeFrame(FRAME_PING, nil)
+}
+
+func encodeMessage(message Message, payload []byte) []byte {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(payload)+64))
+	putString(buffer, message.Tag())
+	putString(buffer, message.ID())
+	putString(buffer, message.Sender())
+	var timestamp int64
+	if !message.Timestamp().IsZero() {
+		timestamp = message.Timestamp().UnixNano()
+	}
+	putUvarint(buffer, uint64(timestamp))
+	keys := sortedHeaderKeys(message)
+	putUvarint(buffer, uint64(len(keys)))
+	for _, key := range keys {
+		putString(buffer, key)
+		putString(buffer, message.Header(key))
+	}
+	buffer.Write(payload)
+	return buffer.Bytes()
+}
+
+func decodeMessage(body []byte) (Message, error) {
+	reader := bytes.NewReader(body)
+	tag, err := getString(reader)
+	if err != nil {
+		return nil, err
+	}
+	id, err := getString(reader)
+	if err != nil {
+		return nil, err
+	}
+	message := newMessageWithID(tag, id)
+	sender, err := getString(reader)
+	if err != nil {
+		return nil, err
+	}
+	message.SetSender(sender)
+	timestamp, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if timestamp != 0 {
+		message.SetTimestamp(time.Unix(0, int64(timestamp)))
+	}
+	headerCount, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < headerCount; i++ {
+		key, err := getString(reader)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getString(reader)
+		if err != nil {
+			return nil, err
+		}
+		message.SetHeader(key, value)
+	}
+	_, err = io.Copy(message, reader)
+	return message, err
+}
+
+func putUvarint(buffer *bytes.Buffer, value uint64) {
+	encoded := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(encoded[:binary.PutUvarint(encoded, value)])
+}
+
+func putString(buffer *bytes.Buffer, value string) {
+	putUvarint(buffer, uint64(len(value)))
+	buffer.WriteString(value)
+}
+
+func getString(reader *bytes.Reader) (string, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	if length > uint64(reader.Len()) {
+		return "", errors.New("invalid message frame")
+	}
+	value := make([]byte, length)
+	_, err = io.ReadFull(reader, value)
+	return string(value), err
+}
@@ -0,0 +1,142 @@
+package pub
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = Describe("BinaryConnection", func() {
+	var clientConn Connection
+	var serverConn Connection
+	binaryPayload := []byte("line\nwith \\n escapes\r\n\x00\xff and no trailing newline")
+
+	BeforeEach(func() {
+		client, server := loopbackPair()
+		clientConn = NewBinaryConnection(client)
+		serverConn = NewBinaryConnection(server)
+	})
+
+	AfterEach(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	It("should send a message exactly", func() {
+		message := NewMessage("tag")
+		message.SetSender("sender")
+		message.SetTimestamp(time.Now())
+		message.SetHeader("trace", "a\nb")
+		message.Write(binaryPayload)
+		Expect(clientConn.SendMessage(message)).Should(Succeed())
+
+		result, err := serverConn.ReceiveMessage()
+		Expect(err).Should(Succeed())
+		Expect(result.Tag()).Should(Equal("tag"))
+		Expect(result.ID()).Should(Equal(message.ID()))
+		Expect(result.Sender()).Should(Equal("sender"))
+		Expect(result.Timestamp().Equal(message.Timestamp())).Should(BeTrue())
+		Expect(result.Headers()).Should(Equal(map[string]string{"trace": "a\nb"}))
+		Expect(ioutil.ReadAll(result)).Should(Equal(binaryPayload))
+	})
+
+	It("should check the tag of a message", func() {
+		message := NewMessage("tag")
+		Expect(clientConn.SendMessage(message)).Should(Succeed())
+		_, err := serverConn.ReceiveMessageWithTag("tig")
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should send a string exactly", func() {
+		Expect(clientConn.SendString(string(binaryPayload))).Should(Succeed())
+		result, err := serverConn.ReceiveString()
+		Expect(err).Should(Succeed())
+		Expect(result).Should(Equal(string(binaryPayload)))
+	})
+
+	It("should not receive a string as message", func() {
+		Expect(clientConn.SendString("abc")).Should(Succeed())
+		_, err := serverConn.ReceiveMessage()
+		Expect(err).Should(HaveOccurred())
+	})
+
+	It("should send a file exactly", func() {
+		defer os.Remove("tmp_binary")
+		defer os.Remove("tmp_binary2")
+		content := []byte(strings.Repeat(string(binaryPayload), 4096))
+		Expect(ioutil.WriteFile("tmp_binary", content, 0644)).Should(Succeed())
+		file, err := os.Open("tmp_binary")
+		Expect(err).Should(Succeed())
+
+		sent := make(chan error, 1)
+		go func() {
+			sent <- clientConn.SendAndCloseFile(file)
+		}()
+		result, err := serverConn.ReceiveFile("tmp_binary2")
+		Expect(err).Should(Succeed())
+		defer result.Close()
+		Eventually(sent).Should(Receive(BeNil()))
+		Expect(ioutil.ReadAll(result)).Should(Equal(content))
+	})
+
+	It("should stream exactly", func() {
+		clientErr := make(chan error, 1)
+		go streamHelper(clientConn, clientErr)
+		Expect(serverConn.StartStream()).Should(Succeed())
+		Eventually(clientErr).Should(Receive(BeNil()))
+
+		n, err := clientConn.Write(binaryPayload)
+		Expect(err).Should(Succeed())
+		Expect(n).Should(Equal(len(binaryPayload)))
+		Expect(clientConn.StopStream()).Should(Succeed())
+
+		result, err := ioutil.ReadAll(io.LimitReader(serverConn, 1<<20))
+		Expect(err).Should(Succeed())
+		Expect(result).Should(Equal(binaryPayload))
+
+		buf := make([]byte, 5)
+		n, err = serverConn.Read(buf)
+		Expect(n).Should(BeZero())
+	})
+
+	It("should stream writes larger than a frame", func() {
+		clientErr := make(chan error, 1)
+		go streamHelper(clientConn, clientErr)
+		Expect(serverConn.StartStream()).Should(Succeed())
+		Eventually(clientErr).Should(Receive(BeNil()))
+
+		large := bytes.Repeat(binaryPayload, MAX_FRAME_SIZE/len(binaryPayload)+1)
+		Expect(len(large)).Should(BeNumerically(">", MAX_FRAME_SIZE))
+		received := make(chan []byte, 1)
+		go func() {
+			result, _ := ioutil.ReadAll(serverConn)
+			received <- result
+		}()
+		n, err := clientConn.Write(large)
+		Expect(err).Should(Succeed())
+		Expect(n).Should(Equal(len(large)))
+		Expect(clientConn.StopStream()).Should(Succeed())
+		Eventually(received, 5*time.Second).Should(Receive(Equal(large)))
+	})
+
+	It("should split a frame over several reads", func() {
+		clientErr := make(chan error, 1)
+		go streamHelper(clientConn, clientErr)
+		Expect(serverConn.StartStream()).Should(Succeed())
+		Eventually(clientErr).Should(Receive(BeNil()))
+
+		clientConn.Write(binaryPayload)
+		buf := make([]byte, 10)
+		n, err := serverConn.Read(buf)
+		Expect(err).Should(Succeed())
+		Expect(buf[:n]).Should(Equal(binaryPayload[:10]))
+		n, err = serverConn.Read(buf)
+		Expect(err).Should(Succeed())
+		Expect(buf[:n]).Should(Equal(binaryPayload[10:20]))
+	})
+})
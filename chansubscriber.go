@@ -0,0 +1,71 @@
+package pub
+
+import (
+	"sync"
+)
+
+//	A ChanSubscriber exposes its messages as a channel, so that it can be used
+//	in a select statement. The channel is closed when the Subscriber is closed.
+type ChanSubscriber interface {
+	Subscriber
+
+	//	Returns the channel that receives the messages.
+	Messages() <-chan Message
+
+	//	Closes the Subscriber and its channel. Buffered messages can still be
+	//	read from the channel, messages received afterwards are discarded.
+	Close() error
+}
+
+type chanSubscriber struct {
+	channel  chan Message
+	closed   chan struct{}
+	isClosed bool
+	once     sync.Once
+	sync.RWMutex
+}
+
+//	Returns a ChanSubscriber that buffers up to DEFAULT_SUBSCRIBER_BUFFER messages
+//	and blocks when its buffer is full. Can be passed to Publisher.Subscribe
+//	directly, use a type assertion to access the channel:
+//		sub := pub.Subscribe("tag", NewChanSubscriber)
+//		messages := sub.(ChanSubscriber).Messages()
+func NewChanSubscriber() Subscriber {
+	return &chanSubscriber{
+		channel: make(chan Message, DEFAULT_SUBSCRIBER_BUFFER),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *chanSubscriber) Messages() <-chan Message {
+	return c.channel
+}
+
+//	Returns the next message or nil if the Subscriber is closed.
+func (c *chanSubscriber) WaitForMessage() Message {
+	return <-c.channel
+}
+
+func (c *chanSubscriber) Receive(message Message) {
+	c.RLock()
+	defer c.RUnlock()
+	if c.isClosed {
+		return
+	}
+	select {
+	case c.channel <- message:
+	case <-c.closed:
+	}
+}
+
+func (c *chanSubscriber) Close() error {
+	c.once.Do(func() {
+		//	Release blocked calls to Receive before waiting for the write lock.
+		close(c.closed)
+		c.Lock()
+		defer c.Unlock()
+		c.isClosed = true
+		close(c.channel)
+	})
+	return nil
+}
@@ -0,0 +1,54 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ChanSubscriber", func() {
+	var sub ChanSubscriber
+
+	BeforeEach(func() {
+		sub = NewChanSubscriber().(ChanSubscriber)
+	})
+
+	It("should place the message in the channel", func() {
+		fillSubscriber(sub, 1)
+		var message Message
+		Eventually(sub.Messages()).Should(Receive(&message))
+		Expect(payloadOf(message)).Should(Equal("0"))
+	})
+
+	It("should be usable with a publisher", func() {
+		pub := New()
+		sub = pub.Subscribe("tag", NewChanSubscriber).(ChanSubscriber)
+		message := NewMessage("tag")
+		message.Write([]byte("abcd"))
+		pub.Publish(message)
+
+		var result Message
+		Eventually(sub.Messages()).Should(Receive(&result))
+		Expect(payloadOf(result)).Should(Equal("abcd"))
+
+		pub.Close()
+		Eventually(sub.Messages()).Should(BeClosed())
+	})
+
+	It("should release a blocked receive when closed", func() {
+		fillSubscriber(sub, DEFAULT_SUBSCRIBER_BUFFER)
+		done := make(chan struct{})
+		go func() {
+			fillSubscriber(sub, 1)
+			close(done)
+		}()
+		Consistently(done).ShouldNot(BeClosed())
+		Expect(sub.Close()).Should(Succeed())
+		Eventually(done).Should(BeClosed())
+		Expect(sub.Close()).Should(Succeed())
+
+		for i := 0; i < DEFAULT_SUBSCRIBER_BUFFER; i++ {
+			Expect(sub.WaitForMessage()).ShouldNot(BeNil())
+		}
+		Expect(sub.WaitForMessage()).Should(BeNil())
+	})
+})
@@ -0,0 +1,446 @@
+//	Command pub is a command line client for pub brokers and peers.
+//
+//	Usage:
+//
+//		pub publish [-addr host:port] [-tls and -auth flags] [-retain] [-header key=value]... <tag>   < payload
+//		pub subscribe [-addr host:port] [-tls and -auth flags] [-since duration] [-tags] <tag>
+//		pub send-file -addr host:port -id <id> <file>
+//		pub recv-file -port <port> -id <id> <file>
+//		pub stream -addr host:port -id <id>    < data
+//		pub stream -port <port> -id <id>       > data
+//
+//	publish and subscribe talk to a broker like pubd. send-file, recv-file and
+//	stream connect two pub processes directly: the receiving side listens at a
+//	port and waits for the sending side to connect with the same ID. An address
+//	of the form unix:<path> connects to a Unix domain socket.
+//
+//	publish and subscribe use TLS if -tls-ca is given: -tls-ca names the PEM
+//	file of the CAs the broker certificate must be signed by, -tls-cert and
+//	-tls-key name a client certificate for brokers that require one. They
+//	authenticate with the secret in the file -auth-secret, with the bearer
+//	token -auth-token or, with -auth-certificate, with the client certificate
+//	if the broker requires it.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gnampfelix/pub"
+)
+
+const DEFAULT_ADDR = "127.0.0.1:9000"
+
+type command struct {
+	run   func(args []string, stdin io.Reader, stdout io.Writer) error
+	usage string
+}
+
+var commands = map[string]command{
+	"publish":   {publish, "[-addr host:port] [-tls and -auth flags] [-retain] [-header key=value]... <tag>"},
+	"subscribe": {subscribe, "[-addr host:port] [-tls and -auth flags] [-since duration] [-tags] <tag>"},
+	"send-file": {sendFile, "-addr host:port -id <id> <file>"},
+	"recv-file": {receiveFile, "-port <port> -id <id> <file>"},
+	"stream":    {stream, "(-addr host:port | -port <port>) -id <id>"},
+}
+
+var errUsage = errors.New("unknown command")
+
+func main() {
+	err := run(os.Args[1:], os.Stdin, os.Stdout)
+	switch {
+	case err == errUsage:
+		usage()
+	case errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "pub %v\n", err)
+		os.Exit(1)
+	}
+}
+
+//	Runs the command named by the first argument with the remaining ones.
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) < 1 {
+		return errUsage
+	}
+	current, ok := commands[args[0]]
+	if !ok {
+		return errUsage
+	}
+	err := current.run(args[1:], stdin, stdout)
+	if err != nil {
+		return fmt.Errorf("%s: %w", args[0], err)
+	}
+	return nil
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range []string{"publish", "subscribe", "send-file", "recv-file", "stream"} {
+		fmt.Fprintf(os.Stderr, "  pub %s %s\n", name, commands[name].usage)
+	}
+	os.Exit(2)
+}
+
+//	headers collects repeated -header flags.
+type headers map[string]string
+
+func (h headers) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h headers) Set(value string) error {
+	key, headerValue, found := strings.Cut(value, "=")
+	if !found {
+		return fmt.Errorf("header %q is not of the form key=value", value)
+	}
+	h[key] = headerValue
+	return nil
+}
+
+func defaultId() string {
+	hostname, _ := os.Hostname()
+	return "pub-" + hostname + "-" + strconv.Itoa(os.Getpid())
+}
+
+//	Parses the flags and returns the only remaining argument.
+func parseWithArgument(flags *flag.FlagSet, args []string, name string) (string, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return "", err
+	}
+	if flags.NArg() != 1 {
+		return "", fmt.Errorf("expected exactly one %s", name)
+	}
+	return flags.Arg(0), nil
+}
+
+//	securityFlags collects the -tls and -auth flags of a command.
+type securityFlags struct {
+	ca          *string
+	cert        *string
+	key         *string
+	secret      *string
+	token       *string
+	certificate *bool
+}
+
+func addSecurityFlags(flags *flag.FlagSet) securityFlags {
+	return securityFlags{
+		ca:          flags.String("tls-ca", "", "PEM file of the CAs the broker certificate must be signed by, enables TLS"),
+		cert:        flags.String("tls-cert", "", "PEM client certificate file"),
+		key:         flags.String("tls-key", "", "PEM key file of the client certificate"),
+		secret:      flags.String("auth-secret", "", "file with the secret to authenticate with"),
+		token:       flags.String("auth-token", "", "bearer token to authenticate with"),
+		certificate: flags.Bool("auth-certificate", false, "authenticate with the client certificate"),
+	}
+}
+
+//	Returns the MessengerConfig for the flags with the given identity.
+func (s securityFlags) config(identity string) (pub.MessengerConfig, error) {
+	result := pub.MessengerConfig{Identity: identity}
+	count := 0
+	for _, given := range []bool{*s.secret != "", *s.token != "", *s.certificate} {
+		if given {
+			count++
+		}
+	}
+	if count > 1 {
+		return result, fmt.Errorf("only one of -auth-secret, -auth-token and -auth-certificate may be given")
+	}
+	switch {
+	case *s.secret != "":
+		secret, err := ioutil.ReadFile(*s.secret)
+		if err != nil {
+			return result, err
+		}
+		result.Authenticator = pub.NewSharedSecretAuthenticator(bytes.TrimSpace(secret))
+	case *s.token != "":
+		result.Authenticator = pub.NewTokenAuthenticator(*s.token, nil)
+	case *s.certificate:
+		if *s.ca == "" || *s.cert == "" || *s.key == "" {
+			return result, fmt.Errorf("-auth-certificate requires -tls-ca, -tls-cert and -tls-key")
+		}
+		result.Authenticator = pub.NewCertificateAuthenticator()
+	}
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		return result, err
+	}
+	result.TLS = tlsConfig
+	return result, nil
+}
+
+//	Returns the TLS config for the flags, nil if TLS is not enabled.
+func (s securityFlags) tlsConfig() (*tls.Config, error) {
+	if *s.ca == "" {
+		return nil, nil
+	}
+	pem, err := ioutil.ReadFile(*s.ca)
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{RootCAs: x509.NewCertPool()}
+	if !result.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", *s.ca)
+	}
+	if *s.cert != "" {
+		certificate, err := tls.LoadX509KeyPair(*s.cert, *s.key)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{certificate}
+	}
+	return result, nil
+}
+
+//	Connects to the remote with the given config and registers with the given
+//	connection ID.
+func talkTo(addr, id string, config pub.MessengerConfig) (pub.Connection, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	conn, err := pub.NewMessengerWithConfig(config).TalkOn(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SendString(id)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+//	Like talkTo, but redials whenever the connection fails and reports the
+//	state changes on stderr.
+func reconnectTo(addr, id string, config pub.MessengerConfig) pub.Connection {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return pub.NewReconnectingConnection(pub.NewMessengerWithConfig(config), network, addr, id, pub.ReconnectOptions{
+		OnStateChange: func(state pub.ConnectionState, err error) {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", state, err)
+			} else {
+				fmt.Fprintln(os.Stderr, state)
+			}
+		},
+	})
+}
+
+//	Listens at the given port until a remote registered with the given
+//	connection ID.
+func awaitRemote(port int, id string) (pub.Connection, error) {
+	messenger := pub.NewMessenger()
+	err := messenger.ListenAt(port, pub.New())
+	if err != nil {
+		return nil, err
+	}
+	defer messenger.StopListening()
+	return messenger.AwaitConversation(context.Background(), id)
+}
+
+func publish(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("publish", flag.ContinueOnError)
+	addr := flags.String("addr", DEFAULT_ADDR, "address of the broker")
+	security := addSecurityFlags(flags)
+	id := flags.String("id", defaultId(), "connection ID")
+	retain := flags.Bool("retain", false, "retain the message as the last value of the tag")
+	messageHeaders := headers{}
+	flags.Var(messageHeaders, "header", "message header as key=value, can be repeated")
+	tag, err := parseWithArgument(flags, args, "tag")
+	if err != nil {
+		return err
+	}
+
+	payload, err := ioutil.ReadAll(stdin)
+	if err != nil {
+		return err
+	}
+	message := pub.NewMessage(tag)
+	for key, value := range messageHeaders {
+		message.SetHeader(key, value)
+	}
+	message.Write(payload)
+
+	config, err := security.config(*id)
+	if err != nil {
+		return err
+	}
+	conn, err := talkTo(*addr, *id, config)
+	if err != nil {
+		return err
+	}
+	remote := pub.NewRemotePublisher(conn)
+	defer remote.Close()
+	if *retain {
+		return remote.PublishRetained(message)
+	}
+	return remote.Publish(message)
+}
+
+func subscribe(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("subscribe", flag.ContinueOnError)
+	addr := flags.String("addr", DEFAULT_ADDR, "address of the broker")
+	security := addSecurityFlags(flags)
+	id := flags.String("id", defaultId(), "connection ID")
+	since := flags.Duration("since", 0, "replay the history of this duration first")
+	printTags := flags.Bool("tags", false, "print the tag in front of every message")
+	reconnect := flags.Bool("reconnect", false, "redial and subscribe again if the connection fails")
+	tag, err := parseWithArgument(flags, args, "tag")
+	if err != nil {
+		return err
+	}
+
+	config, err := security.config(*id)
+	if err != nil {
+		return err
+	}
+	var conn pub.Connection
+	if *reconnect {
+		conn = reconnectTo(*addr, *id, config)
+	} else {
+		conn, err = talkTo(*addr, *id, config)
+		if err != nil {
+			return err
+		}
+	}
+	remote := pub.NewRemotePublisher(conn)
+	defer remote.Close()
+
+	var sub pub.Subscriber
+	if *since > 0 {
+		sub = remote.SubscribeFrom(tag, time.Now().Add(-*since), pub.NewChanSubscriber)
+	} else {
+		sub = remote.Subscribe(tag, pub.NewChanSubscriber)
+	}
+	output := func(message pub.Message) {
+		payload, _ := ioutil.ReadAll(message)
+		if *printTags {
+			fmt.Fprintf(stdout, "%s\t", message.Tag())
+		}
+		stdout.Write(payload)
+		if len(payload) == 0 || payload[len(payload)-1] != '\n' {
+			fmt.Fprintln(stdout)
+		}
+	}
+	messages := sub.(pub.ChanSubscriber).Messages()
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("the broker refused the subscription to %q", tag)
+			}
+			output(message)
+		case <-remote.Done():
+			//	Closing delivers the messages that were already received and
+			//	then closes the channel.
+			go remote.Close()
+			for message := range messages {
+				output(message)
+			}
+			return remote.Err()
+		}
+	}
+}
+
+func sendFile(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("send-file", flag.ContinueOnError)
+	addr := flags.String("addr", DEFAULT_ADDR, "address of the receiving pub")
+	id := flags.String("id", "", "connection ID the receiving pub waits for")
+	filename, err := parseWithArgument(flags, args, "file")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	conn, err := talkTo(*addr, *id, pub.MessengerConfig{})
+	if err != nil {
+		file.Close()
+		return err
+	}
+	defer conn.Close()
+	return conn.SendAndCloseFile(file)
+}
+
+func receiveFile(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("recv-file", flag.ContinueOnError)
+	port := flags.Int("port", 9000, "port to listen at")
+	id := flags.String("id", "", "connection ID to wait for")
+	filename, err := parseWithArgument(flags, args, "file")
+	if err != nil {
+		return err
+	}
+
+	conn, err := awaitRemote(*port, *id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	file, err := conn.ReceiveFile(filename)
+	if file != nil {
+		file.Close()
+	}
+	return err
+}
+
+func stream(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags := flag.NewFlagSet("stream", flag.ContinueOnError)
+	addr := flags.String("addr", "", "address of the receiving pub, stdin is sent")
+	port := flags.Int("port", 0, "port to listen at, the received data is written to stdout")
+	id := flags.String("id", "", "connection ID")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if (*addr == "") == (*port == 0) {
+		return fmt.Errorf("expected either -addr or -port")
+	}
+
+	if *addr != "" {
+		conn, err := talkTo(*addr, *id, pub.MessengerConfig{})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		err = conn.StartStream()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(conn, stdin)
+		if err != nil {
+			return err
+		}
+		return conn.StopStream()
+	}
+
+	conn, err := awaitRemote(*port, *id)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = conn.StartStream()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(stdout, conn)
+	return err
+}
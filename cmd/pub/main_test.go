@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gnampfelix/pub"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//	Issues a CA and a client certificate for "client" signed by it into dir,
+//	as ca.crt, client.crt and client.key. Returns the TLS config of a server
+//	at 127.0.0.1 that requires such client certificates.
+func issueCertificates(dir string) *tls.Config {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).Should(Succeed())
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	Expect(err).Should(Succeed())
+	ca, err := x509.ParseCertificate(caDER)
+	Expect(err).Should(Succeed())
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Expect(err).Should(Succeed())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		Expect(err).Should(Succeed())
+		return der, key
+	}
+	writePEM := func(name, blockType string, bytes []byte) {
+		content := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: bytes})
+		Expect(ioutil.WriteFile(filepath.Join(dir, name), content, 0600)).Should(Succeed())
+	}
+
+	clientDER, clientKey := issue(2, "client", x509.ExtKeyUsageClientAuth)
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	Expect(err).Should(Succeed())
+	writePEM("ca.crt", "CERTIFICATE", caDER)
+	writePEM("client.crt", "CERTIFICATE", clientDER)
+	writePEM("client.key", "EC PRIVATE KEY", keyDER)
+
+	serverDER, serverKey := issue(3, "server", x509.ExtKeyUsageServerAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	}
+}
+
+var _ = Describe("pub", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pub")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(filename, []byte(content), 0600)).Should(Succeed())
+		return filename
+	}
+
+	Context("flags", func() {
+		It("should reject unknown commands", func() {
+			Expect(run(nil, nil, nil)).Should(Equal(errUsage))
+			Expect(run([]string{"unknown"}, nil, nil)).Should(Equal(errUsage))
+		})
+
+		It("should parse headers", func() {
+			result := headers{}
+			Expect(result.Set("trace=a=b")).Should(Succeed())
+			Expect(result.Set("empty=")).Should(Succeed())
+			Expect(result).Should(Equal(headers{"trace": "a=b", "empty": ""}))
+			Expect(result.Set("trace")).ShouldNot(Succeed())
+		})
+
+		It("should expect exactly one argument", func() {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			Expect(parseWithArgument(flags, []string{"tag"}, "tag")).Should(Equal("tag"))
+			_, err := parseWithArgument(flags, []string{}, "tag")
+			Expect(err).Should(MatchError("expected exactly one tag"))
+			_, err = parseWithArgument(flags, []string{"a", "b"}, "tag")
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should configure the authentication", func() {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			security := addSecurityFlags(flags)
+			Expect(flags.Parse([]string{"-auth-secret", writeFile("secret", "s3cr3t\n")})).Should(Succeed())
+			config, err := security.config("client")
+			Expect(err).Should(Succeed())
+			Expect(config.Identity).Should(Equal("client"))
+			Expect(config.TLS).Should(BeNil())
+			Expect(config.Authenticator.Method()).Should(Equal(pub.AUTH_METHOD_SHARED_SECRET))
+		})
+
+		It("should allow only one authentication method", func() {
+			for _, args := range [][]string{
+				{"-auth-secret", "secret", "-auth-token", "token"},
+				{"-auth-token", "token", "-auth-certificate"},
+			} {
+				flags := flag.NewFlagSet("test", flag.ContinueOnError)
+				security := addSecurityFlags(flags)
+				Expect(flags.Parse(args)).Should(Succeed())
+				_, err := security.config("client")
+				Expect(err).Should(MatchError(HavePrefix("only one of")))
+			}
+		})
+
+		It("should require a client certificate to authenticate with", func() {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			security := addSecurityFlags(flags)
+			Expect(flags.Parse([]string{"-tls-ca", writeFile("ca.crt", ""), "-auth-certificate"})).Should(Succeed())
+			_, err := security.config("client")
+			Expect(err).Should(MatchError("-auth-certificate requires -tls-ca, -tls-cert and -tls-key"))
+		})
+	})
+
+	Context("with a broker", func() {
+		var broker pub.Publisher
+		var messenger pub.Messenger
+		var addr string
+		var accepted chan pub.Connection
+		var cancel context.CancelFunc
+
+		//	Serves the Publisher to the command once it registered as
+		//	"client", like pubd would.
+		serve := func(config pub.MessengerConfig, publisher pub.Publisher) {
+			messenger = pub.NewMessengerWithConfig(config)
+			bound, err := messenger.ListenOn("tcp", "127.0.0.1:0", pub.New())
+			Expect(err).Should(Succeed())
+			addr = bound.String()
+
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			accepted = make(chan pub.Connection, 1)
+			go func() {
+				conn, err := messenger.AwaitConversation(ctx, "client")
+				if err != nil {
+					return
+				}
+				accepted <- conn
+				pub.ServePublisher(conn, publisher)
+			}()
+		}
+
+		//	Ends the connection of the command.
+		disconnect := func() {
+			var conn pub.Connection
+			Eventually(accepted).Should(Receive(&conn))
+			conn.Close()
+		}
+
+		BeforeEach(func() {
+			broker = pub.New()
+		})
+
+		AfterEach(func() {
+			cancel()
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+			}
+			messenger.StopListening()
+			broker.Close()
+		})
+
+		It("should publish stdin", func() {
+			serve(pub.MessengerConfig{}, broker)
+			sub := broker.Subscribe("orders.>", pub.NewChanSubscriber).(pub.ChanSubscriber)
+
+			err := run([]string{"publish", "-addr", addr, "-id", "client", "-header", "trace=abc", "orders.eu"},
+				strings.NewReader("order\n"), ioutil.Discard)
+			Expect(err).Should(Succeed())
+			var received pub.Message
+			Eventually(sub.Messages()).Should(Receive(&received))
+			Expect(received.Tag()).Should(Equal("orders.eu"))
+			Expect(received.Headers()).Should(Equal(map[string]string{"trace": "abc"}))
+			Expect(ioutil.ReadAll(received)).Should(Equal([]byte("order\n")))
+		})
+
+		It("should print the subscribed messages", func() {
+			serve(pub.MessengerConfig{}, broker)
+			retained := pub.NewMessage("orders.eu")
+			retained.Write([]byte("order"))
+			Expect(broker.PublishRetained(retained)).Should(Succeed())
+
+			reader, writer := io.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- run([]string{"subscribe", "-addr", addr, "-id", "client", "-tags", "orders.>"}, nil, writer)
+				writer.Close()
+			}()
+			lines := bufio.NewReader(reader)
+			Expect(lines.ReadString('\n')).Should(Equal("orders.eu\torder\n"))
+
+			message := pub.NewMessage("orders.us")
+			message.Write([]byte("second order\n"))
+			Expect(broker.Publish(message)).Should(Succeed())
+			Expect(lines.ReadString('\n')).Should(Equal("orders.us\tsecond order\n"))
+
+			disconnect()
+			Eventually(done).Should(Receive(HaveOccurred()))
+		})
+
+		It("should report denials", func() {
+			acl, err := pub.ParseACL(strings.NewReader("* all public.>\n"))
+			Expect(err).Should(Succeed())
+			serve(pub.MessengerConfig{}, pub.NewACLPublisher(broker, acl, ""))
+
+			err = run([]string{"publish", "-addr", addr, "-id", "client", "orders.eu"}, strings.NewReader(""), ioutil.Discard)
+			Expect(err).Should(MatchError(ContainSubstring(pub.ErrPermissionDenied.Error())))
+		})
+
+		It("should report refused subscriptions", func() {
+			acl, err := pub.ParseACL(strings.NewReader("* all public.>\n"))
+			Expect(err).Should(Succeed())
+			serve(pub.MessengerConfig{}, pub.NewACLPublisher(broker, acl, ""))
+
+			err = run([]string{"subscribe", "-addr", addr, "-id", "client", "orders.>"}, nil, ioutil.Discard)
+			Expect(err).Should(MatchError(ContainSubstring("refused the subscription")))
+		})
+
+		Context("with client certificates", func() {
+			var tlsArgs []string
+
+			BeforeEach(func() {
+				serve(pub.MessengerConfig{
+					TLS:           issueCertificates(dir),
+					Authenticator: pub.NewCertificateAuthenticator(),
+				}, broker)
+				tlsArgs = []string{"-addr", addr, "-id", "client", "-tls-ca", filepath.Join(dir, "ca.crt"),
+					"-tls-cert", filepath.Join(dir, "client.crt"), "-tls-key", filepath.Join(dir, "client.key")}
+			})
+
+			It("should authenticate with the certificate", func() {
+				sub := broker.Subscribe("orders.>", pub.NewChanSubscriber).(pub.ChanSubscriber)
+
+				args := append([]string{"publish", "-auth-certificate"}, tlsArgs...)
+				err := run(append(args, "orders.eu"), strings.NewReader("order\n"), ioutil.Discard)
+				Expect(err).Should(Succeed())
+				var received pub.Message
+				Eventually(sub.Messages()).Should(Receive(&received))
+				Expect(received.Sender()).Should(Equal("client"))
+			})
+
+			It("should fail without -auth-certificate", func() {
+				args := append([]string{"publish"}, tlsArgs...)
+				err := run(append(args, "orders.eu"), strings.NewReader("order\n"), ioutil.Discard)
+				Expect(err).Should(MatchError(ContainSubstring(pub.AUTH_METHOD_CERTIFICATE)))
+			})
+		})
+	})
+})
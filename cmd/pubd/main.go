@@ -0,0 +1,362 @@
+//	Command pubd hosts a Publisher behind a Messenger, so that clients can use
+//	it with a RemotePublisher:
+//
+//		pubd -port 9000 -history-size 100
+//		pubd -port 9000 -socket /run/pubd.sock
+//		pubd -port 9000 -tls-cert pubd.crt -tls-key pubd.key -tls-client-ca clients.crt
+//		pubd -port 9000 -auth-tokens tokens.txt
+//
+//	Every client connects with Messenger.TalkTo, sends a unique connection ID
+//	with SendString and hands the Connection to NewRemotePublisher. On SIGINT
+//	or SIGTERM, pubd stops listening, drains the Publisher, sends the clients
+//	what is still queued for them and closes their connections.
+//
+//	At most one of -auth-secret, -auth-tokens and -auth-certificate may be
+//	given. -auth-secret names a file with a secret shared with all clients.
+//	-auth-tokens names a file with one bearer token and the identity it stands
+//	for per line, separated by whitespace. -auth-certificate requires a client
+//	certificate that is verified by -tls-client-ca.
+//
+//	With -acl, every client may only publish and subscribe to the tags the ACL
+//	file grants its authenticated identity, see pub.ACL. Clients that didn't
+//	authenticate are only granted the rules for "*". On SIGHUP, pubd reads the
+//	ACL file again.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gnampfelix/pub"
+)
+
+type config struct {
+	port            int
+	socket          string
+	identity        string
+	historySize     int
+	historyAge      time.Duration
+	maxConnections  int
+	maxPending      int
+	shutdownTimeout time.Duration
+	disableBinary   bool
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	authSecret      string
+	authTokens      string
+	authCertificate bool
+	acl             string
+	heartbeat       time.Duration
+	handshake       time.Duration
+	verbose         bool
+}
+
+func main() {
+	cfg, err := parseFlags(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	log.SetPrefix("pubd: ")
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	if err := run(cfg, signals); err != nil {
+		log.Fatal(err)
+	}
+}
+
+//	Returns the config for the command line arguments. The flag set reports
+//	errors and the usage itself.
+func parseFlags(args []string) (config, error) {
+	cfg := config{}
+	flags := flag.NewFlagSet("pubd", flag.ContinueOnError)
+	flags.IntVar(&cfg.port, "port", 9000, "TCP port to listen at")
+	flags.StringVar(&cfg.socket, "socket", "", "also listen at this Unix domain socket")
+	flags.StringVar(&cfg.identity, "identity", "pubd", "identity sent to clients in the greeting")
+	flags.IntVar(&cfg.historySize, "history-size", 0, "messages per tag kept for SubscribeFrom")
+	flags.DurationVar(&cfg.historyAge, "history-age", 0, "how long messages are kept for SubscribeFrom")
+	flags.IntVar(&cfg.maxConnections, "max-connections", 0, "maximum number of clients, 0 for no limit")
+	flags.IntVar(&cfg.maxPending, "max-pending", 10000, "deliveries a client may fall behind before it is dropped, 0 for no limit")
+	flags.DurationVar(&cfg.shutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for pending deliveries on shutdown")
+	flags.BoolVar(&cfg.disableBinary, "disable-binary", false, "only offer the text protocol")
+	flags.StringVar(&cfg.tlsCert, "tls-cert", "", "PEM certificate file, enables TLS")
+	flags.StringVar(&cfg.tlsKey, "tls-key", "", "PEM key file of the certificate")
+	flags.StringVar(&cfg.tlsClientCA, "tls-client-ca", "", "PEM file of the CAs that client certificates must be signed by")
+	flags.StringVar(&cfg.authSecret, "auth-secret", "", "file with the secret clients authenticate with")
+	flags.StringVar(&cfg.authTokens, "auth-tokens", "", "file with the bearer tokens clients authenticate with")
+	flags.BoolVar(&cfg.authCertificate, "auth-certificate", false, "authenticate clients by their TLS certificate")
+	flags.StringVar(&cfg.acl, "acl", "", "file with the access rules of the clients, reloaded on SIGHUP")
+	flags.DurationVar(&cfg.heartbeat, "heartbeat", 0, "ping clients at this interval and drop those that stay silent, 0 to disable")
+	flags.DurationVar(&cfg.handshake, "handshake-timeout", 10*time.Second, "drop clients that don't register within this duration, 0 for no limit")
+	flags.BoolVar(&cfg.verbose, "verbose", false, "log every client connection")
+	err := flags.Parse(args)
+	if err == nil && flags.NArg() > 0 {
+		err = fmt.Errorf("unexpected argument %q", flags.Arg(0))
+		fmt.Fprintln(flags.Output(), err)
+	}
+	return cfg, err
+}
+
+//	Serves the broker until a signal other than SIGHUP is received.
+func run(cfg config, signals <-chan os.Signal) error {
+	broker := pub.NewWithOptions(pub.PublisherOptions{
+		HistorySize: cfg.historySize,
+		HistoryAge:  cfg.historyAge,
+	})
+
+	// The Messenger announces every registered connection on this Publisher,
+	// tagged with the connection ID. ">" needs at least one level, the empty
+	// pattern catches IDs without any, like "".
+	registrations := pub.New()
+	ready := registrations.Subscribe(pub.MULTI_LEVEL_WILDCARD, pub.NewChanSubscriber).(pub.ChanSubscriber)
+	registrations.Subscribe("", func() pub.Subscriber {
+		return ready
+	})
+
+	tlsConfig, err := loadTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	authenticator, err := loadAuthenticator(cfg)
+	if err != nil {
+		return err
+	}
+	var acl *pub.ACL
+	if cfg.acl != "" {
+		acl, err = pub.LoadACL(cfg.acl)
+		if err != nil {
+			return err
+		}
+	}
+	messenger := pub.NewMessengerWithConfig(pub.MessengerConfig{
+		Identity:         cfg.identity,
+		DisableBinary:    cfg.disableBinary,
+		TLS:              tlsConfig,
+		Authenticator:    authenticator,
+		HandshakeTimeout: cfg.handshake,
+		Heartbeat: pub.HeartbeatOptions{
+			Interval: cfg.heartbeat,
+			OnDeadPeer: func(conn pub.Connection, err error) {
+				log.Printf("dropping client (%s): %s", conn.Peer().Identity, err)
+			},
+		},
+	})
+	addr, err := messenger.ListenOn("tcp", ":"+strconv.Itoa(cfg.port), registrations)
+	if err != nil {
+		return err
+	}
+	log.Printf("listening at %s", addr)
+	if cfg.socket != "" {
+		_, err = messenger.ListenOn("unix", cfg.socket, registrations)
+		if err != nil {
+			messenger.StopListening()
+			return err
+		}
+		log.Printf("listening at %s", cfg.socket)
+	}
+
+	clients := newClients(cfg.maxConnections, cfg.maxPending, cfg.verbose)
+	for {
+		select {
+		case notification := <-ready.Messages():
+			if notification.Tag() == pub.AUTH_FAILURE_TAG {
+				reason, _ := ioutil.ReadAll(notification)
+				log.Printf("rejected %s (%q): %s", notification.Header(pub.AUTH_ADDRESS_HEADER),
+					notification.Header(pub.AUTH_IDENTITY_HEADER), reason)
+				continue
+			}
+			conn, ok := messenger.StartConversation(notification.Tag())
+			if !ok {
+				continue
+			}
+			clients.serve(notification.Tag(), conn, publisherFor(conn, broker, acl))
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadACL(acl)
+				continue
+			}
+			log.Printf("received %s, shutting down", sig)
+			if err := messenger.StopListening(); err != nil {
+				log.Printf("stopping to listen: %s", err)
+			}
+			registrations.Close()
+
+			// The clients stay connected until the broker handed them the
+			// remaining messages, and then get what is still queued for them.
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
+			defer cancel()
+			err := broker.Drain(ctx)
+			deadline, _ := ctx.Deadline()
+			clients.closeAll(deadline)
+			return err
+		}
+	}
+}
+
+//	Returns the Publisher the client is served with: the broker itself or, with
+//	an ACL, the broker restricted to the rules of the client's identity.
+func publisherFor(conn pub.Connection, broker pub.Publisher, acl *pub.ACL) pub.Publisher {
+	if acl == nil {
+		return broker
+	}
+	return pub.NewACLPublisher(broker, acl, conn.Peer().AuthenticatedIdentity())
+}
+
+func reloadACL(acl *pub.ACL) {
+	if acl == nil {
+		return
+	}
+	if err := acl.Reload(); err != nil {
+		log.Printf("keeping the current ACL: %s", err)
+		return
+	}
+	log.Printf("reloaded the ACL")
+}
+
+//	Returns the TLS config for the -tls flags, nil if TLS is not enabled.
+func loadTLSConfig(cfg config) (*tls.Config, error) {
+	if cfg.tlsCert == "" {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(cfg.tlsCert, cfg.tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	result := &tls.Config{Certificates: []tls.Certificate{certificate}}
+	if cfg.tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(cfg.tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		result.ClientCAs = x509.NewCertPool()
+		if !result.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.tlsClientCA)
+		}
+		result.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return result, nil
+}
+
+//	Returns the Authenticator for the -auth flags, nil if clients don't have to
+//	authenticate.
+func loadAuthenticator(cfg config) (pub.Authenticator, error) {
+	var result pub.Authenticator
+	count := 0
+	if cfg.authSecret != "" {
+		secret, err := ioutil.ReadFile(cfg.authSecret)
+		if err != nil {
+			return nil, err
+		}
+		result = pub.NewSharedSecretAuthenticator(bytes.TrimSpace(secret))
+		count++
+	}
+	if cfg.authTokens != "" {
+		content, err := ioutil.ReadFile(cfg.authTokens)
+		if err != nil {
+			return nil, err
+		}
+		identities := make(map[string]string)
+		for i, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("%s:%d: expected a token and an identity", cfg.authTokens, i+1)
+			}
+			identities[fields[0]] = fields[1]
+		}
+		result = pub.NewTokenAuthenticator("", identities)
+		count++
+	}
+	if cfg.authCertificate {
+		if cfg.tlsClientCA == "" {
+			return nil, fmt.Errorf("-auth-certificate requires -tls-client-ca")
+		}
+		result = pub.NewCertificateAuthenticator()
+		count++
+	}
+	if count > 1 {
+		return nil, fmt.Errorf("only one of -auth-secret, -auth-tokens and -auth-certificate may be given")
+	}
+	return result, nil
+}
+
+//	clients keeps track of the served connections, so that they can be limited
+//	and closed on shutdown.
+type clients struct {
+	connections map[string]pub.Connection
+	max         int
+	maxPending  int
+	verbose     bool
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+func newClients(max, maxPending int, verbose bool) *clients {
+	return &clients{connections: make(map[string]pub.Connection), max: max, maxPending: maxPending, verbose: verbose}
+}
+
+func (c *clients) serve(connId string, conn pub.Connection, broker pub.Publisher) {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.connections[connId]; ok {
+		log.Printf("rejecting client %q: connection ID already in use", connId)
+		conn.Close()
+		return
+	}
+	if c.max > 0 && len(c.connections) >= c.max {
+		log.Printf("rejecting client %q: limit of %d connections reached", connId, c.max)
+		conn.Close()
+		return
+	}
+	c.connections[connId] = conn
+	if c.verbose {
+		log.Printf("client %q (%s) connected", connId, conn.Peer().Identity)
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		err := pub.ServePublisherWithOptions(conn, broker, pub.ServeOptions{MaxPending: c.maxPending})
+		conn.Close()
+		c.Lock()
+		delete(c.connections, connId)
+		c.Unlock()
+		if err == pub.ErrSlowRemote {
+			log.Printf("dropped client %q: more than %d deliveries pending", connId, c.maxPending)
+		} else if c.verbose {
+			log.Printf("client %q disconnected: %v", connId, err)
+		}
+	}()
+}
+
+//	Stops serving all clients. The read deadline in the past ends
+//	ServePublisher, which still sends the queued deliveries until the given
+//	deadline. The connections are closed once it returned.
+func (c *clients) closeAll(deadline time.Time) {
+	c.Lock()
+	for _, conn := range c.connections {
+		conn.SetWriteDeadline(deadline)
+		conn.SetReadDeadline(time.Unix(1, 0))
+	}
+	c.Unlock()
+	c.wg.Wait()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gnampfelix/pub"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+//	peerConnection reports a fixed Peer, so that publisherFor can be tested
+//	without a handshake.
+type peerConnection struct {
+	pub.Connection
+	peer pub.Peer
+}
+
+func (p peerConnection) Peer() pub.Peer {
+	return p.peer
+}
+
+var _ = Describe("pubd", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "pubd")
+		Expect(err).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	writeFile := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		Expect(ioutil.WriteFile(filename, []byte(content), 0600)).Should(Succeed())
+		return filename
+	}
+
+	Context("flags", func() {
+		It("should keep the defaults", func() {
+			cfg, err := parseFlags(nil)
+			Expect(err).Should(Succeed())
+			Expect(cfg.port).Should(Equal(9000))
+			Expect(cfg.identity).Should(Equal("pubd"))
+			Expect(cfg.maxPending).Should(Equal(10000))
+			Expect(cfg.shutdownTimeout).Should(Equal(10 * time.Second))
+			Expect(cfg.handshake).Should(Equal(10 * time.Second))
+		})
+
+		It("should parse the flags", func() {
+			cfg, err := parseFlags([]string{"-port", "9100", "-history-size", "10", "-history-age", "1m",
+				"-auth-tokens", "tokens.txt", "-acl", "acl.txt", "-heartbeat", "5s", "-verbose"})
+			Expect(err).Should(Succeed())
+			Expect(cfg.port).Should(Equal(9100))
+			Expect(cfg.historySize).Should(Equal(10))
+			Expect(cfg.historyAge).Should(Equal(time.Minute))
+			Expect(cfg.authTokens).Should(Equal("tokens.txt"))
+			Expect(cfg.acl).Should(Equal("acl.txt"))
+			Expect(cfg.heartbeat).Should(Equal(5 * time.Second))
+			Expect(cfg.verbose).Should(BeTrue())
+		})
+
+		It("should reject unknown flags and arguments", func() {
+			_, err := parseFlags([]string{"-unknown"})
+			Expect(err).Should(HaveOccurred())
+			_, err = parseFlags([]string{"-port", "9100", "extra"})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("authentication", func() {
+		It("should not require authentication by default", func() {
+			Expect(loadAuthenticator(config{})).Should(BeNil())
+		})
+
+		It("should read the shared secret", func() {
+			result, err := loadAuthenticator(config{authSecret: writeFile("secret", "s3cr3t\n")})
+			Expect(err).Should(Succeed())
+			Expect(result.Method()).Should(Equal(pub.AUTH_METHOD_SHARED_SECRET))
+		})
+
+		It("should read the bearer tokens", func() {
+			result, err := loadAuthenticator(config{authTokens: writeFile("tokens", "token-1 billing\n\ntoken-2 shipping\n")})
+			Expect(err).Should(Succeed())
+			Expect(result.Method()).Should(Equal(pub.AUTH_METHOD_TOKEN))
+		})
+
+		It("should reject malformed token files", func() {
+			_, err := loadAuthenticator(config{authTokens: writeFile("tokens", "token-1 billing\ntoken-2\n")})
+			Expect(err).Should(MatchError(HaveSuffix(":2: expected a token and an identity")))
+		})
+
+		It("should require a client CA for certificates", func() {
+			_, err := loadAuthenticator(config{authCertificate: true})
+			Expect(err).Should(HaveOccurred())
+			result, err := loadAuthenticator(config{authCertificate: true, tlsClientCA: "clients.crt"})
+			Expect(err).Should(Succeed())
+			Expect(result.Method()).Should(Equal(pub.AUTH_METHOD_CERTIFICATE))
+		})
+
+		It("should allow only one method", func() {
+			_, err := loadAuthenticator(config{authSecret: writeFile("secret", "s3cr3t"), authCertificate: true, tlsClientCA: "clients.crt"})
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("ACL", func() {
+		var acl *pub.ACL
+
+		BeforeEach(func() {
+			var err error
+			acl, err = pub.ParseACL(strings.NewReader("billing publish invoices.>\n* publish public.>\n"))
+			Expect(err).Should(Succeed())
+		})
+
+		It("should serve the broker itself without an ACL", func() {
+			broker := pub.New()
+			Expect(publisherFor(peerConnection{}, broker, nil)).Should(BeIdenticalTo(broker))
+		})
+
+		It("should grant the rules of the authenticated identity", func() {
+			conn := peerConnection{peer: pub.Peer{Identity: "billing", Authenticated: true}}
+			publisher := publisherFor(conn, pub.New(), acl)
+			Expect(publisher.Publish(pub.NewMessage("invoices.eu"))).Should(Succeed())
+			Expect(publisher.Publish(pub.NewMessage("public.news"))).Should(Succeed())
+		})
+
+		It("should only grant the rules for everyone to a claimed identity", func() {
+			conn := peerConnection{peer: pub.Peer{Identity: "billing"}}
+			publisher := publisherFor(conn, pub.New(), acl)
+			Expect(publisher.Publish(pub.NewMessage("invoices.eu"))).Should(Equal(pub.ErrPermissionDenied))
+			Expect(publisher.Publish(pub.NewMessage("public.news"))).Should(Succeed())
+		})
+	})
+
+	Context("serving", func() {
+		var socket string
+		var signals chan os.Signal
+		var done chan error
+
+		start := func(args ...string) {
+			socket = filepath.Join(dir, "pubd.sock")
+			cfg, err := parseFlags(append([]string{"-port", "0", "-socket", socket}, args...))
+			Expect(err).Should(Succeed())
+			signals = make(chan os.Signal, 1)
+			done = make(chan error, 1)
+			go func() {
+				done <- run(cfg, signals)
+			}()
+		}
+
+		stop := func() {
+			signals <- syscall.SIGTERM
+			Eventually(done, 15*time.Second).Should(Receive(BeNil()))
+		}
+
+		connect := func(id string, config pub.MessengerConfig) *pub.RemotePublisher {
+			var conn pub.Connection
+			Eventually(func() error {
+				var err error
+				conn, err = pub.NewMessengerWithConfig(config).TalkOn("unix", socket)
+				return err
+			}).Should(Succeed())
+			Expect(conn.SendString(id)).Should(Succeed())
+			return pub.NewRemotePublisher(conn)
+		}
+
+		It("should pass messages between clients", func() {
+			start()
+			subscriber := connect("subscriber", pub.MessengerConfig{})
+			defer subscriber.Close()
+			sub := subscriber.Subscribe("orders.>", pub.NewChanSubscriber).(pub.ChanSubscriber)
+			publisher := connect("publisher", pub.MessengerConfig{})
+			defer publisher.Close()
+
+			message := pub.NewMessage("orders.eu")
+			message.Write([]byte("order\n"))
+			Expect(publisher.Publish(message)).Should(Succeed())
+			var received pub.Message
+			Eventually(sub.Messages()).Should(Receive(&received))
+			Expect(received.Tag()).Should(Equal("orders.eu"))
+			Expect(ioutil.ReadAll(received)).Should(Equal([]byte("order\n")))
+			stop()
+		})
+
+		It("should deliver the published messages before it shuts down", func() {
+			start()
+			subscriber := connect("subscriber", pub.MessengerConfig{})
+			defer subscriber.Close()
+			sub := subscriber.Subscribe("orders.>", pub.NewChanSubscriber).(pub.ChanSubscriber)
+			publisher := connect("publisher", pub.MessengerConfig{})
+			defer publisher.Close()
+
+			for i := 0; i < 100; i++ {
+				Expect(publisher.Publish(pub.NewMessage("orders.eu"))).Should(Succeed())
+			}
+			stop()
+			received := 0
+			Eventually(func() int {
+				for {
+					select {
+					case <-sub.Messages():
+						received++
+					default:
+						return received
+					}
+				}
+			}).Should(Equal(100))
+		})
+
+		It("should restrict authenticated clients to their rules", func() {
+			start("-auth-tokens", writeFile("tokens", "token-1 billing\n"),
+				"-acl", writeFile("acl", "billing publish invoices.>\n"))
+			client := connect("billing", pub.MessengerConfig{Authenticator: pub.NewTokenAuthenticator("token-1", nil)})
+			defer client.Close()
+
+			Expect(client.Publish(pub.NewMessage("invoices.eu"))).Should(Succeed())
+			Expect(client.Publish(pub.NewMessage("orders.eu"))).Should(Equal(pub.ErrPermissionDenied))
+			stop()
+		})
+	})
+})
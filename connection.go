@@ -8,6 +8,9 @@ import (
 	"net"
 	"net/textproto"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,6 +18,10 @@ const (
 	MESSAGE_TAG       = 201
 	MESSAGE_LINE      = 202
 	MESSAGE_END       = 203
+	MESSAGE_ID        = 204
+	MESSAGE_TIMESTAMP = 205
+	MESSAGE_SENDER    = 206
+	MESSAGE_HEADER    = 207
 	STRING            = 301
 	FILE_PREFIX       = 40
 	FILE_START        = 401
@@ -36,11 +43,14 @@ const (
 //	(according to POSIX, all lines must end with \n). For example, if a file is to
 //	be send that doesn't end "correctly" with \n, the \n is added on the receiving side.
 //	The resulting file will have a \n at the end. An error does not close the connection,
-//	although the connection might by out of sync afterwards.
+//	although the connection might by out of sync afterwards. A Connection created
+//	by NewBinaryConnection doesn't have these limitations, it transfers all items
+//	byte by byte.
 type Connection interface {
 	//	Send a message to a remote. The message is closed before sending.
 	//	The tag of the message should not contain "\n"-characters, as they
-	//	would (currently) break the connection.
+	//	would (currently) break the connection. The ID, timestamp, sender and
+	//	headers of the message are transported as well.
 	//	Returns an error if the message could not be delivered or if the connections
 	//	is set into streaming mode.
 	SendMessage(message Message) error
@@ -79,6 +89,19 @@ type Connection interface {
 	//	Unsets the streaming mode. Does not wait for a remote confirmation.
 	StopStream() error
 
+	//	Returns what is known about the remote from the handshake. Connections
+	//	that were created without a handshake return the zero Peer.
+	Peer() Peer
+
+	//	Set the deadlines of the underlying net.Conn, see net.Conn. An operation
+	//	that exceeds a deadline fails with a timeout error and may stop in the
+	//	middle of a message, so the Connection should be closed afterwards. The
+	//	zero time disables a deadline. See ReceiveMessageContext and the other
+	//	context-aware functions to bound a single operation.
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+
 	//	Read and Write can only be used when in streaming mode. Every call to Write
 	//	sends the given data at once. All occurences of "\n" are replaced by "\\n".
 	//	This is reverted on the reading side. Callers must make sure that no "\\n"
@@ -89,11 +112,90 @@ type Connection interface {
 
 //	Converts the given connection into a Connection.
 func NewConnection(conn net.Conn) Connection {
-	return &connection{conn: textproto.NewConn(conn), readBuffer: bytes.NewBuffer(make([]byte, 0))}
+	return newTextConnection(conn, bufio.NewReader(conn), Peer{})
+}
+
+//	Creates a Connection that reads from the given reader, so that data that
+//	was already buffered during the handshake is not lost.
+func newTextConnection(conn net.Conn, reader *bufio.Reader, peer Peer) *connection {
+	return &connection{
+		conn: &textConn{
+			Reader: textproto.NewReader(reader),
+			Writer: textproto.NewWriter(bufio.NewWriter(conn)),
+			Closer: conn,
+		},
+		netConn:    conn,
+		readBuffer: bytes.NewBuffer(make([]byte, 0)),
+		peer:       peer,
+	}
+}
+
+//	A textConn works like a textproto.Conn, but its reader can be shared. It
+//	answers and skips heartbeats on every read and serializes the writes of
+//	single lines, so that pongs can be sent while the Connection is in use.
+type textConn struct {
+	*textproto.Reader
+	*textproto.Writer
+	io.Closer
+	liveness
+	writeLock sync.Mutex
+}
+
+func (t *textConn) PrintfLine(format string, args ...interface{}) error {
+	t.writeLock.Lock()
+	defer t.writeLock.Unlock()
+	return t.Writer.PrintfLine(format, args...)
+}
+
+//	Works like textproto.Reader.ReadCodeLine, but skips heartbeats.
+func (t *textConn) ReadCodeLine(expectCode int) (int, string, error) {
+	for {
+		code, message, err := t.Reader.ReadCodeLine(0)
+		if err != nil {
+			return code, message, err
+		}
+		t.markSeen()
+		switch code {
+		case PING:
+			err = t.PrintfLine("%d %s", PONG, PONG_TEXT)
+			if err != nil {
+				return code, message, err
+			}
+			continue
+		case PONG:
+			continue
+		}
+		if !matchesCode(code, expectCode) {
+			return code, message, &textproto.Error{Code: code, Msg: message}
+		}
+		return code, message, nil
+	}
+}
+
+func (t *textConn) Close() error {
+	t.markClosed()
+	return t.Closer.Close()
+}
+
+//	Checks the code like textproto does: an expected code with less than three
+//	digits is a prefix, zero matches every code.
+func matchesCode(code, expectCode int) bool {
+	switch {
+	case expectCode <= 0:
+		return true
+	case expectCode < 10:
+		return code/100 == expectCode
+	case expectCode < 100:
+		return code/10 == expectCode
+	default:
+		return code == expectCode
+	}
 }
 
 type connection struct {
-	conn        *textproto.Conn
+	conn        *textConn
+	netConn     net.Conn
+	peer        Peer
 	readBuffer  *bytes.Buffer
 	isStreaming bool
 }
@@ -109,6 +211,13 @@ func (c *connection) SendMessage(message Message) error {
 	if err != nil {
 		return err
 	}
+	//	Legacy peers only know tag, lines and end, so they can't read metadata.
+	if c.peer.Version != LEGACY_PROTOCOL_VERSION {
+		err = c.sendMetadata(message)
+		if err != nil {
+			return err
+		}
+	}
 
 	scanner := bufio.NewScanner(message)
 	for scanner.Scan() {
@@ -121,6 +230,32 @@ func (c *connection) SendMessage(message Message) error {
 	return err
 }
 
+func (c *connection) sendMetadata(message Message) error {
+	err := c.conn.PrintfLine("%d %s", MESSAGE_ID, message.ID())
+	if err != nil {
+		return err
+	}
+	if !message.Timestamp().IsZero() {
+		err = c.conn.PrintfLine("%d %s", MESSAGE_TIMESTAMP, message.Timestamp().Format(time.RFC3339Nano))
+		if err != nil {
+			return err
+		}
+	}
+	if message.Sender() != "" {
+		err = c.conn.PrintfLine("%d %s", MESSAGE_SENDER, message.Sender())
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedHeaderKeys(message) {
+		err = c.conn.PrintfLine("%d %s: %s", MESSAGE_HEADER, key, message.Header(key))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *connection) SendString(message string) error {
 	if c.isStreaming {
 		return errors.New("can't send string when streaming")
@@ -160,22 +295,7 @@ func (c *connection) ReceiveMessageWithTag(tag string) (Message, error) {
 	if receivedTag != tag {
 		return nil, errors.New("the received tag didn't match the expected tag")
 	}
-
-	message := NewMessage(tag)
-	for {
-		currentCode, currentLine, err := c.conn.ReadCodeLine(MESSAGE_PREFIX)
-		if err != nil {
-			break
-		}
-		if currentCode == MESSAGE_END {
-			return message, nil
-		} else if currentCode == MESSAGE_LINE {
-			message.Write([]byte(currentLine + "\n"))
-		} else {
-			return message, errors.New("can't read multiple tag lines")
-		}
-	}
-	return message, err
+	return c.receiveMessageBody(tag)
 }
 
 func (c *connection) ReceiveMessage() (Message, error) {
@@ -186,21 +306,42 @@ func (c *connection) ReceiveMessage() (Message, error) {
 	if err != nil {
 		return nil, err
 	}
+	return c.receiveMessageBody(tag)
+}
+
+//	Reads the metadata and payload lines of a message up to the end line.
+func (c *connection) receiveMessageBody(tag string) (Message, error) {
 	message := NewMessage(tag)
 	for {
 		currentCode, currentLine, err := c.conn.ReadCodeLine(MESSAGE_PREFIX)
 		if err != nil {
-			break
+			return message, err
 		}
-		if currentCode == MESSAGE_END {
+		switch currentCode {
+		case MESSAGE_END:
 			return message, nil
-		} else if currentCode == MESSAGE_LINE {
+		case MESSAGE_LINE:
 			message.Write([]byte(currentLine + "\n"))
-		} else {
+		case MESSAGE_ID:
+			message.SetID(currentLine)
+		case MESSAGE_TIMESTAMP:
+			timestamp, err := time.Parse(time.RFC3339Nano, currentLine)
+			if err != nil {
+				return message, err
+			}
+			message.SetTimestamp(timestamp)
+		case MESSAGE_SENDER:
+			message.SetSender(currentLine)
+		case MESSAGE_HEADER:
+			key, value, found := strings.Cut(currentLine, ": ")
+			if !found {
+				return message, errors.New("invalid header line")
+			}
+			message.SetHeader(key, value)
+		default:
 			return message, errors.New("can't read multiple tag lines")
 		}
 	}
-	return message, err
 }
 
 func (c *connection) ReceiveString() (string, error) {
@@ -315,6 +456,38 @@ func (c *connection) Read(p []byte) (int, error) {
 	return n, nil
 }
 
+func (c *connection) Peer() Peer {
+	return c.peer
+}
+
+func (c *connection) setPeer(peer Peer) {
+	c.peer = peer
+}
+
+func (c *connection) SetDeadline(t time.Time) error {
+	return c.netConn.SetDeadline(t)
+}
+
+func (c *connection) SetReadDeadline(t time.Time) error {
+	return c.netConn.SetReadDeadline(t)
+}
+
+func (c *connection) SetWriteDeadline(t time.Time) error {
+	return c.netConn.SetWriteDeadline(t)
+}
+
 func (c *connection) Close() error {
 	return c.conn.Close()
 }
+
+func (c *connection) ping() error {
+	return c.conn.PrintfLine("%d %s", PING, PING_TEXT)
+}
+
+func (c *connection) lastSeen() time.Time {
+	return c.conn.lastSeen()
+}
+
+func (c *connection) isClosed() bool {
+	return c.conn.isClosed()
+}
@@ -1,6 +1,7 @@
 package pub
 
 import (
+	"context"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	"io/ioutil"
@@ -15,7 +16,6 @@ var _ = Describe("Connection", func() {
 	var client Messenger
 	var clientConn Connection
 	var serverConn Connection
-	var sub Subscriber
 	var pub Publisher
 	connId := "abcdefg"
 
@@ -25,18 +25,20 @@ var _ = Describe("Connection", func() {
 			we generate random ports to use for each test.
 		*/
 		currentPort := int(rand.Int31n(100)) + 9000
-		server = NewMessenger()
+		// These specs cover the text protocol, so binary framing is disabled.
+		server = NewMessengerWithConfig(MessengerConfig{DisableBinary: true})
 		pub = New()
-		sub = pub.Subscribe(connId, NewSubscriber)
+		pub.Subscribe(connId, NewSubscriber)
 
 		server.ListenAt(currentPort, pub)
 
 		client = NewMessenger()
 		clientConn, _ = client.TalkTo("127.0.0.1:" + strconv.Itoa(currentPort))
 		clientConn.SendString(connId)
-		time.Sleep(20 * time.Millisecond)
 
-		serverConn, _ = server.StartConversation(connId)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serverConn, _ = server.AwaitConversation(ctx, connId)
 	})
 
 	AfterEach(func() {
@@ -58,6 +60,27 @@ var _ = Describe("Connection", func() {
 		Expect(resultInBytes).Should(Equal([]byte("payload\n")))
 	})
 
+	It("should send the metadata of a message", func() {
+		message := NewMessage("tag")
+		message.SetSender("sender")
+		message.SetTimestamp(time.Now())
+		message.SetHeader("trace", "abc: def")
+		message.SetHeader("empty", "")
+		message.Write([]byte("payload"))
+		err := clientConn.SendMessage(message)
+		Expect(err).Should(Succeed())
+
+		result, err := serverConn.ReceiveMessage()
+		Expect(err).Should(Succeed())
+		Expect(result.ID()).Should(Equal(message.ID()))
+		Expect(result.Sender()).Should(Equal("sender"))
+		Expect(result.Timestamp().Equal(message.Timestamp())).Should(BeTrue())
+		Expect(result.Headers()).Should(Equal(map[string]string{"trace": "abc: def", "empty": ""}))
+		resultInBytes, err := ioutil.ReadAll(result)
+		Expect(err).Should(Succeed())
+		Expect(resultInBytes).Should(Equal([]byte("payload\n")))
+	})
+
 	It("should not receive a message", func() {
 		message := NewMessage("tag")
 		message.Write([]byte("payload"))
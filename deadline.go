@@ -0,0 +1,108 @@
+package pub
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+//	The context-aware functions bound a single operation of a Connection by the
+//	context: its deadline becomes the deadline of the Connection, and canceling
+//	the context interrupts the operation. They return the error of the context
+//	if it ended the operation. The deadline is cleared afterwards, so they
+//	replace deadlines that were set before. Like an exceeded deadline, an
+//	interrupted operation may leave the Connection in the middle of an item, so
+//	it should be closed afterwards.
+
+//	Sends the message, see Connection.SendMessage.
+func SendMessageContext(ctx context.Context, conn Connection, message Message) error {
+	return withContext(ctx, conn.SetWriteDeadline, func() error {
+		return conn.SendMessage(message)
+	})
+}
+
+//	Waits for any message, see Connection.ReceiveMessage.
+func ReceiveMessageContext(ctx context.Context, conn Connection) (Message, error) {
+	var result Message
+	err := withContext(ctx, conn.SetReadDeadline, func() error {
+		var err error
+		result, err = conn.ReceiveMessage()
+		return err
+	})
+	return result, err
+}
+
+//	Waits for a string, see Connection.ReceiveString.
+func ReceiveStringContext(ctx context.Context, conn Connection) (string, error) {
+	var result string
+	err := withContext(ctx, conn.SetReadDeadline, func() error {
+		var err error
+		result, err = conn.ReceiveString()
+		return err
+	})
+	return result, err
+}
+
+//	Waits for a file and saves it, see Connection.ReceiveFile.
+func ReceiveFileContext(ctx context.Context, conn Connection, filename string) (*os.File, error) {
+	var result *os.File
+	err := withContext(ctx, conn.SetReadDeadline, func() error {
+		var err error
+		result, err = conn.ReceiveFile(filename)
+		return err
+	})
+	return result, err
+}
+
+//	Sets the connection into streaming mode, see Connection.StartStream.
+func StartStreamContext(ctx context.Context, conn Connection) error {
+	return withContext(ctx, conn.SetDeadline, func() error {
+		return conn.StartStream()
+	})
+}
+
+func withContext(ctx context.Context, setDeadline func(time.Time) error, operation func() error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	err = setDeadline(deadline)
+	if err != nil {
+		return err
+	}
+	defer setDeadline(time.Time{})
+
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				//	A deadline in the past interrupts the blocked operation.
+				setDeadline(time.Unix(1, 0))
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+
+	err = operation()
+	if !isTimeout(err) {
+		//	Other errors are reported as they are, even if the context ended
+		//	meanwhile.
+		return err
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	//	The Connection may notice the deadline before the context does.
+	if hasDeadline && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package pub
+
+import (
+	"bytes"
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"time"
+)
+
+var _ = Describe("Deadlines", func() {
+	for name, newConnection := range connectionTypes {
+		newConnection := newConnection
+
+		Context("on "+name+" connections", func() {
+			var rawClient, rawServer net.Conn
+			var clientConn Connection
+			var serverConn Connection
+
+			BeforeEach(func() {
+				rawClient, rawServer = loopbackPair()
+				clientConn = newConnection(rawClient)
+				serverConn = newConnection(rawServer)
+			})
+
+			AfterEach(func() {
+				clientConn.Close()
+				serverConn.Close()
+			})
+
+			It("should fail reads after the read deadline", func() {
+				Expect(clientConn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))).Should(Succeed())
+				_, err := clientConn.ReceiveMessage()
+				Expect(err).Should(HaveOccurred())
+				netErr, ok := err.(net.Error)
+				Expect(ok).Should(BeTrue())
+				Expect(netErr.Timeout()).Should(BeTrue())
+			})
+
+			It("should end a receive with the deadline of the context", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+				_, err := ReceiveMessageContext(ctx, clientConn)
+				Expect(err).Should(Equal(context.DeadlineExceeded))
+			})
+
+			It("should interrupt a receive once the context is canceled", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					time.Sleep(20 * time.Millisecond)
+					cancel()
+				}()
+				_, err := ReceiveStringContext(ctx, clientConn)
+				Expect(err).Should(Equal(context.Canceled))
+			})
+
+			It("should clear the deadline afterwards", func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				Expect(serverConn.SendString("in time")).Should(Succeed())
+				result, err := ReceiveStringContext(ctx, clientConn)
+				Expect(err).Should(Succeed())
+				Expect(result).Should(Equal("in time"))
+
+				cancel()
+				time.Sleep(20 * time.Millisecond)
+				Expect(serverConn.SendString("later")).Should(Succeed())
+				Expect(clientConn.ReceiveString()).Should(Equal("later"))
+			})
+
+			It("should end a send to a remote that doesn't read", func() {
+				//	Small socket buffers keep the kernel from taking the whole
+				//	payload, which has to fit in a frame.
+				Expect(rawClient.(*net.TCPConn).SetWriteBuffer(64 << 10)).Should(Succeed())
+				Expect(rawServer.(*net.TCPConn).SetReadBuffer(64 << 10)).Should(Succeed())
+				payload := bytes.Repeat([]byte("a line that fills the buffers\n"), 1<<17)
+				Expect(len(payload)).Should(BeNumerically("<", MAX_FRAME_SIZE))
+				message := NewMessage("large")
+				message.Write(payload)
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				Expect(SendMessageContext(ctx, clientConn, message)).Should(Equal(context.DeadlineExceeded))
+			})
+
+			It("should not start with a finished context", func() {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				Expect(StartStreamContext(ctx, clientConn)).Should(Equal(context.Canceled))
+			})
+		})
+	}
+})
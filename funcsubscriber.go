@@ -0,0 +1,120 @@
+package pub
+
+import (
+	"fmt"
+	"sync"
+)
+
+const DEFAULT_FUNC_WORKERS = 1
+
+//	A FuncSubscriber hands every received message to a handler func that runs on
+//	a bounded pool of worker goroutines. A panic in the handler is recovered and
+//	reported by Err, the worker keeps running.
+type FuncSubscriber interface {
+	Subscriber
+
+	//	Returns and resets the last panic of the handler as an error.
+	Err() error
+
+	//	Stops accepting messages and waits until the handler returned for every
+	//	message that was received before. A Receive that is blocked because all
+	//	workers are busy returns right away and its message is dropped.
+	Close() error
+}
+
+type funcSubscriber struct {
+	handler func(Message)
+	jobs    chan Message
+	done    chan struct{}
+	workers sync.WaitGroup
+	err     error
+	errLock sync.Mutex
+	once    sync.Once
+}
+
+//	Returns a factory for Publisher.Subscribe that creates a FuncSubscriber with
+//	DEFAULT_FUNC_WORKERS workers. With a single worker, the handler is invoked
+//	in publish order.
+//		pub.Subscribe("tag", NewFuncSubscriber(func(message Message) {
+//			...
+//		}))
+func NewFuncSubscriber(handler func(Message)) func() Subscriber {
+	return NewFuncSubscriberWithWorkers(handler, DEFAULT_FUNC_WORKERS)
+}
+
+//	Same as NewFuncSubscriber, but the handler is invoked by up to the given number
+//	of workers concurrently. Receive blocks while all workers are busy. With more
+//	than one worker, the handler may see the messages out of order.
+func NewFuncSubscriberWithWorkers(handler func(Message), workers int) func() Subscriber {
+	if workers <= 0 {
+		workers = DEFAULT_FUNC_WORKERS
+	}
+	return func() Subscriber {
+		result := &funcSubscriber{
+			handler: handler,
+			jobs:    make(chan Message),
+			done:    make(chan struct{}),
+		}
+		result.workers.Add(workers)
+		for i := 0; i < workers; i++ {
+			go result.work()
+		}
+		return result
+	}
+}
+
+//	The handler consumes all messages, therefore WaitForMessage always returns nil.
+func (f *funcSubscriber) WaitForMessage() Message {
+	return nil
+}
+
+func (f *funcSubscriber) Receive(message Message) {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	select {
+	case f.jobs <- message:
+	case <-f.done:
+	}
+}
+
+func (f *funcSubscriber) work() {
+	defer f.workers.Done()
+	for {
+		select {
+		case message := <-f.jobs:
+			f.handle(message)
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (f *funcSubscriber) handle(message Message) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			f.errLock.Lock()
+			f.err = fmt.Errorf("handler panicked: %v", recovered)
+			f.errLock.Unlock()
+		}
+	}()
+	f.handler(message)
+}
+
+func (f *funcSubscriber) Err() error {
+	f.errLock.Lock()
+	defer f.errLock.Unlock()
+	err := f.err
+	f.err = nil
+	return err
+}
+
+func (f *funcSubscriber) Close() error {
+	f.once.Do(func() {
+		close(f.done)
+	})
+	f.workers.Wait()
+	return nil
+}
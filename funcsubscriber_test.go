@@ -0,0 +1,107 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("FuncSubscriber", func() {
+	It("should invoke the handler in order", func() {
+		var lock sync.Mutex
+		received := make([]string, 0)
+		handler := func(message Message) {
+			lock.Lock()
+			defer lock.Unlock()
+			received = append(received, payloadOf(message))
+		}
+
+		pub := New()
+		pub.Subscribe("tag", NewFuncSubscriber(handler))
+		expected := make([]string, 100)
+		for i := range expected {
+			expected[i] = strconv.Itoa(i)
+			message := NewMessage("tag")
+			message.Write([]byte(expected[i]))
+			pub.Publish(message)
+		}
+		Expect(pub.Close()).Should(Succeed())
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(received).Should(Equal(expected))
+	})
+
+	It("should not run more handlers than workers", func() {
+		var lock sync.Mutex
+		running, maxRunning := 0, 0
+		handler := func(message Message) {
+			lock.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			lock.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+		}
+
+		sub := NewFuncSubscriberWithWorkers(handler, 3)()
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fillSubscriber(sub, 2)
+			}()
+		}
+		wg.Wait()
+		sub.(FuncSubscriber).Close()
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(maxRunning).Should(Equal(3))
+	})
+
+	It("should recover from a panicking handler", func() {
+		calls := make(chan string, 2)
+		sub := NewFuncSubscriber(func(message Message) {
+			payload := payloadOf(message)
+			calls <- payload
+			if payload == "0" {
+				panic("boom")
+			}
+		})()
+		fillSubscriber(sub, 2)
+		Expect(sub.(FuncSubscriber).Close()).Should(Succeed())
+		Expect(calls).Should(HaveLen(2))
+		Expect(sub.(FuncSubscriber).Err()).Should(MatchError(ContainSubstring("boom")))
+		Expect(sub.(FuncSubscriber).Err()).Should(BeNil())
+	})
+
+	It("should not block Close on a Receive that waits for a busy worker", func() {
+		release := make(chan struct{})
+		sub := NewFuncSubscriber(func(message Message) {
+			<-release
+		})()
+		sub.Receive(NewMessage("busy"))
+		received := make(chan struct{})
+		go func() {
+			sub.Receive(NewMessage("waiting"))
+			close(received)
+		}()
+		Consistently(received, 20*time.Millisecond).ShouldNot(BeClosed())
+		closed := make(chan error, 1)
+		go func() {
+			closed <- sub.(FuncSubscriber).Close()
+		}()
+		Eventually(received).Should(BeClosed())
+		Consistently(closed, 50*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Eventually(closed).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,207 @@
+package pub
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	HELLO                   = 101
+	HELLO_REPLY             = 102
+	PROTOCOL_VERSION        = 2
+	LEGACY_PROTOCOL_VERSION = 1
+	FEATURE_BINARY          = "binary"
+	FEATURE_HEARTBEAT       = "heartbeat"
+)
+
+//	A Peer describes the remote side of a Connection as learned from the
+//	handshake.
+type Peer struct {
+	//	The identity the remote claimed in its greeting. If Authenticated is
+	//	true, the identity that the Authenticator established instead.
+	Identity string
+
+	//	True if the remote was verified by the Authenticator of the Messenger.
+	Authenticated bool
+
+	//	The negotiated protocol version. LEGACY_PROTOCOL_VERSION means that the
+	//	remote didn't send a greeting at all.
+	Version int
+
+	//	The features both sides support.
+	Features []string
+
+	//	The state of the TLS connection, nil if the connection doesn't use TLS.
+	TLS *tls.ConnectionState
+}
+
+//	Returns true if the feature was negotiated.
+func (p Peer) Supports(feature string) bool {
+	for _, current := range p.Features {
+		if current == feature {
+			return true
+		}
+	}
+	return false
+}
+
+//	Returns the identity that the Authenticator established, "" if the remote
+//	didn't authenticate. Unlike Identity, it can't be picked by the remote, so
+//	it is the one to decide on, e.g. with NewACLPublisher. An ACL grants ""
+//	only the rules for ACL_ANY_IDENTITY.
+func (p Peer) AuthenticatedIdentity() string {
+	if !p.Authenticated {
+		return ""
+	}
+	return p.Identity
+}
+
+//	Returns the certificate the remote presented in the TLS handshake, nil if
+//	there was none. Unlike Identity, the certificate was verified if the
+//	tls.Config asked for it.
+func (p Peer) Certificate() *x509.Certificate {
+	if p.TLS == nil || len(p.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return p.TLS.PeerCertificates[0]
+}
+
+//	A hello is the greeting both sides exchange before anything else. It is sent
+//	as a single text line, so that it can be read regardless of the protocol
+//	that is used afterwards:
+//		101 version=2&id=node-1&features=binary&auth=token
+//	The server answers with HELLO_REPLY, the negotiated version (the lower one
+//	of both), its own identity and the features both sides support. If binary
+//	framing was negotiated, both sides switch to the binary protocol right
+//	after the reply. Both sides name the method of their Authenticator in auth,
+//	which is left out without one, so that the client can tell a mismatch
+//	before it authenticates.
+type hello struct {
+	version  int
+	identity string
+	features []string
+	auth     string
+}
+
+func (h hello) encode() string {
+	values := url.Values{}
+	values.Set("version", strconv.Itoa(h.version))
+	values.Set("id", h.identity)
+	values.Set("features", strings.Join(h.features, ","))
+	if h.auth != "" {
+		values.Set("auth", h.auth)
+	}
+	return values.Encode()
+}
+
+func parseHello(line string) (hello, error) {
+	values, err := url.ParseQuery(line)
+	if err != nil {
+		return hello{}, err
+	}
+	version, err := strconv.Atoi(values.Get("version"))
+	if err != nil || version < 1 {
+		return hello{}, errors.New("invalid protocol version in greeting")
+	}
+	features := make([]string, 0)
+	if values.Get("features") != "" {
+		features = strings.Split(values.Get("features"), ",")
+	}
+	return hello{version: version, identity: values.Get("id"), features: features, auth: values.Get("auth")}, nil
+}
+
+func (h hello) peer() Peer {
+	return Peer{Identity: h.identity, Version: h.version, Features: h.features}
+}
+
+//	Returns a hello with the lower version of both and the common features. The
+//	authentication method stays the local one.
+func (h hello) negotiate(remote hello) hello {
+	result := hello{version: h.version, identity: h.identity, features: make([]string, 0), auth: h.auth}
+	if remote.version < result.version {
+		result.version = remote.version
+	}
+	for _, feature := range h.features {
+		if remote.peer().Supports(feature) {
+			result.features = append(result.features, feature)
+		}
+	}
+	return result
+}
+
+//	Greets the server and creates the Connection for the negotiated protocol.
+//	The reply of the server is returned as well.
+func clientHandshake(conn net.Conn, local hello) (Connection, hello, error) {
+	reader := bufio.NewReader(conn)
+	writer := textproto.NewWriter(bufio.NewWriter(conn))
+	err := writer.PrintfLine("%d %s", HELLO, local.encode())
+	if err != nil {
+		return nil, hello{}, err
+	}
+	_, line, err := textproto.NewReader(reader).ReadCodeLine(HELLO_REPLY)
+	if err != nil {
+		return nil, hello{}, err
+	}
+	reply, err := parseHello(line)
+	if err != nil {
+		return nil, hello{}, err
+	}
+	return connectionFor(conn, reader, reply.peer()), reply, nil
+}
+
+//	Waits for the greeting of a client, answers it and creates the Connection for
+//	the negotiated protocol. A client that doesn't greet but sends its connection
+//	ID right away is treated as a legacy client. In that case, the connection ID
+//	is returned as well.
+func serverHandshake(conn net.Conn, local hello) (Connection, string, error) {
+	reader := bufio.NewReader(conn)
+	code, line, err := textproto.NewReader(reader).ReadCodeLine(0)
+	if err != nil {
+		return nil, "", err
+	}
+	switch code {
+	case STRING:
+		legacy := Peer{Version: LEGACY_PROTOCOL_VERSION, Features: make([]string, 0)}
+		return newTextConnection(conn, reader, withTLS(conn, legacy)), line, nil
+	case HELLO:
+		remote, err := parseHello(line)
+		if err != nil {
+			return nil, "", err
+		}
+		reply := local.negotiate(remote)
+		writer := textproto.NewWriter(bufio.NewWriter(conn))
+		err = writer.PrintfLine("%d %s", HELLO_REPLY, reply.encode())
+		if err != nil {
+			return nil, "", err
+		}
+		peer := Peer{Identity: remote.identity, Version: reply.version, Features: reply.features}
+		return connectionFor(conn, reader, peer), "", nil
+	default:
+		return nil, "", errors.New("expected a greeting")
+	}
+}
+
+func connectionFor(conn net.Conn, reader *bufio.Reader, peer Peer) Connection {
+	peer = withTLS(conn, peer)
+	if peer.Supports(FEATURE_BINARY) {
+		return newBinaryConnection(conn, reader, peer)
+	}
+	return newTextConnection(conn, reader, peer)
+}
+
+//	Adds the TLS state to the peer if conn is a TLS connection. The TLS
+//	handshake is complete at this point, since the greeting was read over it.
+func withTLS(conn net.Conn, peer Peer) Peer {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		peer.TLS = &state
+	}
+	return peer
+}
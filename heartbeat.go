@@ -0,0 +1,185 @@
+package pub
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+//	Codes of the text protocol and frame types of the binary protocol for
+//	heartbeats. Both are answered and skipped by every read of a Connection, so
+//	they may arrive at any time.
+const (
+	PING       = 601
+	PONG       = 602
+	PING_TEXT  = "PING"
+	PONG_TEXT  = "PONG"
+	FRAME_PING = 9
+	FRAME_PONG = 10
+)
+
+var ErrDeadPeer = errors.New("remote didn't answer the heartbeat in time")
+
+//	HeartbeatOptions configure StartHeartbeat and the heartbeats of a Messenger.
+type HeartbeatOptions struct {
+	//	How often a ping is sent. Zero disables the heartbeat of a Messenger.
+	Interval time.Duration
+
+	//	How long the remote may stay silent before it is considered dead. Zero
+	//	means three times the interval.
+	Timeout time.Duration
+
+	//	Called once if the remote is considered dead, after the Connection was
+	//	closed. err is ErrDeadPeer or the error of sending a ping.
+	OnDeadPeer func(conn Connection, err error)
+}
+
+//	A Heartbeat pings the remote of a Connection and closes the Connection once
+//	the remote stayed silent for too long. Everything that is read from the
+//	Connection counts as a sign of life, so the Connection has to be read
+//	continuously, e.g. by a RemotePublisher or ServePublisher, and the remote
+//	has to read as well to answer the pings.
+type Heartbeat struct {
+	conn    Connection
+	options HeartbeatOptions
+	dead    chan struct{}
+	stop    chan struct{}
+	err     error
+	once    sync.Once
+	sync.Mutex
+}
+
+//	The part of a Connection that a Heartbeat needs.
+type heartbeatConnection interface {
+	Connection
+	ping() error
+	lastSeen() time.Time
+	isClosed() bool
+}
+
+//	Starts to ping the remote of the Connection, which must be created by pub.
+//	The remote must support heartbeats, see FEATURE_HEARTBEAT.
+func StartHeartbeat(conn Connection, options HeartbeatOptions) (*Heartbeat, error) {
+	target, ok := conn.(heartbeatConnection)
+	if !ok {
+		return nil, errors.New("connection doesn't support heartbeats")
+	}
+	if options.Interval <= 0 {
+		return nil, errors.New("heartbeat interval must be positive")
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = 3 * options.Interval
+	}
+	result := &Heartbeat{
+		conn:    conn,
+		options: options,
+		dead:    make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	go result.run(target)
+	return result, nil
+}
+
+//	Pings are sent in the background, so that a remote that doesn't read
+//	anymore can't block the heartbeat. At most one ping is pending at a time.
+func (h *Heartbeat) run(conn heartbeatConnection) {
+	started := time.Now()
+	ticker := time.NewTicker(h.options.Interval)
+	defer ticker.Stop()
+	pinged := make(chan error, 1)
+	pending := false
+	for {
+		select {
+		case <-h.stop:
+			return
+		case err := <-pinged:
+			pending = false
+			if err != nil && !conn.isClosed() {
+				h.die(err)
+				return
+			}
+			continue
+		case <-ticker.C:
+		}
+		if conn.isClosed() {
+			return
+		}
+		lastSeen := conn.lastSeen()
+		if lastSeen.Before(started) {
+			lastSeen = started
+		}
+		if time.Since(lastSeen) > h.options.Timeout {
+			h.die(ErrDeadPeer)
+			return
+		}
+		if !pending {
+			pending = true
+			go func() {
+				pinged <- conn.ping()
+			}()
+		}
+	}
+}
+
+func (h *Heartbeat) die(err error) {
+	h.Lock()
+	h.err = err
+	h.Unlock()
+	h.conn.Close()
+	close(h.dead)
+	if h.options.OnDeadPeer != nil {
+		h.options.OnDeadPeer(h.conn, err)
+	}
+}
+
+//	Returns a channel that is closed once the remote is considered dead.
+func (h *Heartbeat) Dead() <-chan struct{} {
+	return h.dead
+}
+
+//	Returns why the remote is considered dead, nil while it is alive.
+func (h *Heartbeat) Err() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
+
+//	Stops pinging without closing the Connection. A Heartbeat also stops on its
+//	own once the Connection is closed.
+func (h *Heartbeat) Stop() {
+	h.once.Do(func() {
+		close(h.stop)
+	})
+}
+
+//	liveness records when something was last read from a Connection and
+//	whether it was closed locally.
+type liveness struct {
+	seen   time.Time
+	closed bool
+	sync.Mutex
+}
+
+func (l *liveness) markSeen() {
+	l.Lock()
+	defer l.Unlock()
+	l.seen = time.Now()
+}
+
+func (l *liveness) lastSeen() time.Time {
+	l.Lock()
+	defer l.Unlock()
+	return l.seen
+}
+
+func (l *liveness) markClosed() {
+	l.Lock()
+	defer l.Unlock()
+	l.closed = true
+}
+
+func (l *liveness) isClosed() bool {
+	l.Lock()
+	defer l.Unlock()
+	return l.closed
+}
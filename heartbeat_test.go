@@ -0,0 +1,127 @@
+package pub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"time"
+)
+
+var _ = Describe("Heartbeat", func() {
+	for name, newConnection := range connectionTypes {
+		newConnection := newConnection
+
+		Context("over "+name+" connections", func() {
+			var clientConn Connection
+			var serverConn Connection
+			var rawServer net.Conn
+
+			BeforeEach(func() {
+				var rawClient net.Conn
+				rawClient, rawServer = loopbackPair()
+				clientConn = newConnection(rawClient)
+				serverConn = newConnection(rawServer)
+			})
+
+			AfterEach(func() {
+				clientConn.Close()
+				serverConn.Close()
+			})
+
+			//	Reads strings from the connection until it fails.
+			receiveStrings := func(conn Connection) (<-chan string, <-chan error) {
+				received := make(chan string, 10)
+				failed := make(chan error, 1)
+				go func() {
+					for {
+						result, err := conn.ReceiveString()
+						if err != nil {
+							failed <- err
+							return
+						}
+						received <- result
+					}
+				}()
+				return received, failed
+			}
+
+			It("should keep a live connection open", func() {
+				heartbeat, err := StartHeartbeat(clientConn, HeartbeatOptions{Interval: 5 * time.Millisecond, Timeout: 50 * time.Millisecond})
+				Expect(err).Should(Succeed())
+				defer heartbeat.Stop()
+				clientReceived, _ := receiveStrings(clientConn)
+				serverReceived, _ := receiveStrings(serverConn)
+
+				Consistently(heartbeat.Dead(), 200*time.Millisecond).ShouldNot(BeClosed())
+				Expect(serverConn.SendString("to client")).Should(Succeed())
+				Expect(clientConn.SendString("to server")).Should(Succeed())
+				Eventually(clientReceived).Should(Receive(Equal("to client")))
+				Eventually(serverReceived).Should(Receive(Equal("to server")))
+				Expect(heartbeat.Err()).Should(BeNil())
+			})
+
+			It("should close the connection to a silent remote", func() {
+				reported := make(chan error, 1)
+				heartbeat, err := StartHeartbeat(clientConn, HeartbeatOptions{
+					Interval: 5 * time.Millisecond,
+					Timeout:  50 * time.Millisecond,
+					OnDeadPeer: func(conn Connection, err error) {
+						reported <- err
+					},
+				})
+				Expect(err).Should(Succeed())
+				_, failed := receiveStrings(clientConn)
+
+				Eventually(heartbeat.Dead()).Should(BeClosed())
+				Expect(heartbeat.Err()).Should(Equal(ErrDeadPeer))
+				Expect(reported).Should(Receive(Equal(ErrDeadPeer)))
+				Eventually(failed).Should(Receive())
+			})
+
+			It("should stop once the connection is closed", func() {
+				reported := make(chan error, 1)
+				heartbeat, err := StartHeartbeat(clientConn, HeartbeatOptions{
+					Interval: 5 * time.Millisecond,
+					OnDeadPeer: func(conn Connection, err error) {
+						reported <- err
+					},
+				})
+				Expect(err).Should(Succeed())
+				clientConn.Close()
+				rawServer.Close()
+				Consistently(reported, 100*time.Millisecond).ShouldNot(Receive())
+				Expect(heartbeat.Dead()).ShouldNot(BeClosed())
+			})
+		})
+	}
+
+	It("should be started by a messenger", func() {
+		server := NewMessenger()
+		bound, err := server.ListenOn("tcp", "127.0.0.1:0", New())
+		Expect(err).Should(Succeed())
+		defer server.StopListening()
+
+		reported := make(chan error, 1)
+		client := NewMessengerWithConfig(MessengerConfig{Heartbeat: HeartbeatOptions{
+			Interval: 5 * time.Millisecond,
+			Timeout:  50 * time.Millisecond,
+			OnDeadPeer: func(conn Connection, err error) {
+				reported <- err
+			},
+		}})
+		clientConn, err := client.TalkTo(bound.String())
+		Expect(err).Should(Succeed())
+		defer clientConn.Close()
+		Expect(clientConn.SendString("silent")).Should(Succeed())
+		go clientConn.ReceiveString()
+
+		// The server never reads, so it doesn't answer the pings.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		serverConn, err := server.AwaitConversation(ctx, "silent")
+		Expect(err).Should(Succeed())
+		defer serverConn.Close()
+		Eventually(reported).Should(Receive(Equal(ErrDeadPeer)))
+	})
+})
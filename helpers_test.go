@@ -0,0 +1,137 @@
+package pub
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//	Fixtures shared by the tests of several files.
+
+//	The constructors of both protocols, for tests that run over each of them.
+var connectionTypes = map[string]func(net.Conn) Connection{
+	"text":   NewConnection,
+	"binary": NewBinaryConnection,
+}
+
+//	Returns both ends of a TCP connection on the loopback interface.
+func loopbackPair() (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).Should(Succeed())
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		Expect(err).Should(Succeed())
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	Expect(err).Should(Succeed())
+	return client, <-accepted
+}
+
+func fillSubscriber(sub Subscriber, count int) {
+	for i := 0; i < count; i++ {
+		message := NewMessage("tag")
+		message.Write([]byte(strconv.Itoa(i)))
+		sub.Receive(message)
+	}
+}
+
+func payloadOf(message Message) string {
+	payload, _ := ioutil.ReadAll(message)
+	return string(payload)
+}
+
+//	Records the payloads of all received messages in order. Every call to
+//	Receive sleeps a little, so that the publisher has to queue up messages.
+type recordingSubscriber struct {
+	payloads []string
+	sync.Mutex
+}
+
+func (r *recordingSubscriber) WaitForMessage() Message {
+	return nil
+}
+
+func (r *recordingSubscriber) Receive(message Message) {
+	payload, _ := ioutil.ReadAll(message)
+	time.Sleep(time.Duration(rand.Int63n(int64(50 * time.Microsecond))))
+	r.Lock()
+	defer r.Unlock()
+	r.payloads = append(r.payloads, string(payload))
+}
+
+func (r *recordingSubscriber) received() []string {
+	r.Lock()
+	defer r.Unlock()
+	result := make([]string, len(r.payloads))
+	copy(result, r.payloads)
+	return result
+}
+
+func newRecordingSubscriber() Subscriber {
+	return &recordingSubscriber{payloads: make([]string, 0)}
+}
+
+//	A CA and a server and client certificate signed by it.
+type testCertificates struct {
+	pool   *x509.CertPool
+	server tls.Certificate
+	client tls.Certificate
+}
+
+func newTestCertificates() testCertificates {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	Expect(err).Should(Succeed())
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(crand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	Expect(err).Should(Succeed())
+	ca, err := x509.ParseCertificate(caDER)
+	Expect(err).Should(Succeed())
+
+	issue := func(serial int64, name string, usage x509.ExtKeyUsage) tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+		Expect(err).Should(Succeed())
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		}
+		der, err := x509.CreateCertificate(crand.Reader, template, ca, &key.PublicKey, caKey)
+		Expect(err).Should(Succeed())
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return testCertificates{
+		pool:   pool,
+		server: issue(2, "server", x509.ExtKeyUsageServerAuth),
+		client: issue(3, "client", x509.ExtKeyUsageClientAuth),
+	}
+}
@@ -0,0 +1,89 @@
+package pub
+
+import (
+	"time"
+)
+
+type historyEntry struct {
+	sequence  uint64
+	published time.Time
+	storedMessage
+}
+
+//	A historyRing keeps the last entries of a single tag. If size is positive,
+//	at most size entries are kept, if maxAge is positive, entries older than
+//	maxAge are dropped.
+type historyRing struct {
+	entries []historyEntry
+	start   int
+	count   int
+	size    int
+	maxAge  time.Duration
+}
+
+func newHistoryRing(size int, maxAge time.Duration) *historyRing {
+	return &historyRing{
+		entries: make([]historyEntry, 0),
+		size:    size,
+		maxAge:  maxAge,
+	}
+}
+
+func (h *historyRing) add(entry historyEntry) {
+	h.expire(entry.published)
+	if h.size > 0 && h.count == h.size {
+		h.entries[h.start] = entry
+		h.start = (h.start + 1) % h.size
+		return
+	}
+	if h.count < len(h.entries) {
+		h.entries[(h.start+h.count)%len(h.entries)] = entry
+	} else {
+		h.grow()
+		h.entries = append(h.entries, entry)
+	}
+	h.count++
+}
+
+//	Moves the entries to the front of the slice, so that the next entry can be
+//	appended.
+func (h *historyRing) grow() {
+	if h.start == 0 {
+		return
+	}
+	entries := make([]historyEntry, h.count, h.count+1)
+	for i := range entries {
+		entries[i] = h.at(i)
+	}
+	h.entries = entries
+	h.start = 0
+}
+
+func (h *historyRing) at(i int) historyEntry {
+	return h.entries[(h.start+i)%len(h.entries)]
+}
+
+//	Drops all entries that are older than maxAge at the given time.
+func (h *historyRing) expire(now time.Time) {
+	if h.maxAge <= 0 {
+		return
+	}
+	for h.count > 0 && now.Sub(h.at(0).published) > h.maxAge {
+		h.entries[h.start] = historyEntry{}
+		h.start = (h.start + 1) % len(h.entries)
+		h.count--
+	}
+}
+
+//	Returns the entries that were published at or after since, oldest first.
+func (h *historyRing) since(since time.Time) []historyEntry {
+	h.expire(time.Now())
+	result := make([]historyEntry, 0)
+	for i := 0; i < h.count; i++ {
+		entry := h.at(i)
+		if !entry.published.Before(since) {
+			result = append(result, entry)
+		}
+	}
+	return result
+}
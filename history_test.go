@@ -0,0 +1,50 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"strconv"
+	"time"
+)
+
+func historyPayloads(entries []historyEntry) []string {
+	result := make([]string, len(entries))
+	for i := range entries {
+		result[i] = string(entries[i].payload)
+	}
+	return result
+}
+
+var _ = Describe("History", func() {
+	It("should keep the last entries", func() {
+		ring := newHistoryRing(3, 0)
+		now := time.Now()
+		for i := 0; i < 7; i++ {
+			ring.add(historyEntry{sequence: uint64(i), published: now, payload: []byte(strconv.Itoa(i))})
+		}
+		Expect(historyPayloads(ring.since(time.Time{}))).Should(Equal([]string{"4", "5", "6"}))
+	})
+
+	It("should only return entries since the given time", func() {
+		ring := newHistoryRing(10, 0)
+		start := time.Now()
+		for i := 0; i < 5; i++ {
+			ring.add(historyEntry{published: start.Add(time.Duration(i) * time.Second), payload: []byte(strconv.Itoa(i))})
+		}
+		Expect(historyPayloads(ring.since(start.Add(3 * time.Second)))).Should(Equal([]string{"3", "4"}))
+	})
+
+	It("should drop expired entries", func() {
+		ring := newHistoryRing(0, time.Minute)
+		now := time.Now()
+		ring.add(historyEntry{published: now.Add(-2 * time.Minute), payload: []byte("old")})
+		ring.add(historyEntry{published: now.Add(-90 * time.Second), payload: []byte("older")})
+		ring.add(historyEntry{published: now, payload: []byte("new")})
+		ring.add(historyEntry{published: now, payload: []byte("newer")})
+		Expect(historyPayloads(ring.since(time.Time{}))).Should(Equal([]string{"new", "newer"}))
+		for i := 0; i < 10; i++ {
+			ring.add(historyEntry{published: now, payload: []byte(strconv.Itoa(i))})
+		}
+		Expect(ring.since(time.Time{})).Should(HaveLen(12))
+	})
+})
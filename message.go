@@ -2,11 +2,18 @@ package pub
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"io"
+	"sort"
+	"time"
 )
 
 //	A Message represents a streamed byte content connected to a tag.
-//	Callers can write to, read from and close it.
+//	Callers can write to, read from and close it. Besides the tag, a Message
+//	carries metadata: a unique ID, the publish timestamp, the identity of the
+//	sender and arbitrary key/value headers. Keys must not contain ':' or "\n"
+//	and values must not contain "\n" to be transported by a Connection.
 type Message interface {
 	//	Sets the tag of the Message.
 	SetTag(tag string)
@@ -14,25 +21,119 @@ type Message interface {
 	//	Returns the tag of the Message.
 	Tag() string
 
+	//	Returns the unique ID of the Message. NewMessage generates a random ID.
+	ID() string
+
+	//	Sets the ID of the Message.
+	SetID(id string)
+
+	//	Returns the time the Message was published first. It is zero until the
+	//	Message is published.
+	Timestamp() time.Time
+
+	//	Sets the publish timestamp of the Message. A Publisher only sets it if
+	//	it is zero.
+	SetTimestamp(timestamp time.Time)
+
+	//	Returns the identity of the sender, empty if unknown.
+	Sender() string
+
+	//	Sets the identity of the sender.
+	SetSender(sender string)
+
+	//	Returns the value of the header with the given key, empty if not set.
+	Header(key string) string
+
+	//	Sets the header with the given key. Unlike writing, this is still
+	//	possible after the Message was closed.
+	SetHeader(key, value string)
+
+	//	Returns a copy of all headers.
+	Headers() map[string]string
+
 	//	Read from, Write to and Close the Message. After closing the message,
 	//	only writing is prohibited, not reading.
 	io.ReadWriteCloser
 }
 
-//	Returns a Message with the given tag.
+//	Returns a Message with the given tag and a new random ID.
 func NewMessage(tag string) Message {
+	return newMessageWithID(tag, newMessageID())
+}
+
+//	Same as NewMessage, but with the given ID instead of a random one. Copies
+//	of a message use this, so that they don't draw a random ID just to
+//	replace it.
+func newMessageWithID(tag, id string) Message {
 	buffer := bytes.NewBuffer(make([]byte, 0))
 	return &simpleMessage{tag: tag,
+		id:       id,
 		buffer:   buffer,
 		isSealed: false,
+		headers:  make(map[string]string),
 	}
 }
 
+func newMessageID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+//	Returns a new Message with the tag and metadata of the given message and the
+//	given payload.
+func copyMessage(message Message, payload []byte) Message {
+	result := newMessageWithID(message.Tag(), message.ID())
+	copyMetadata(message, result)
+	result.Write(payload)
+	return result
+}
+
+func copyMetadata(from, to Message) {
+	to.SetID(from.ID())
+	to.SetTimestamp(from.Timestamp())
+	to.SetSender(from.Sender())
+	for key, value := range from.Headers() {
+		to.SetHeader(key, value)
+	}
+}
+
+//	Returns the header keys of the message in sorted order.
+func sortedHeaderKeys(message Message) []string {
+	headers := message.Headers()
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//	A storedMessage keeps the metadata and the payload of a published Message,
+//	so that copies of it can be delivered later.
+type storedMessage struct {
+	header  Message
+	payload []byte
+}
+
+func newStoredMessage(message Message, payload []byte) storedMessage {
+	header := newMessageWithID(message.Tag(), message.ID())
+	copyMetadata(message, header)
+	return storedMessage{header: header, payload: payload}
+}
+
+func (s storedMessage) message() Message {
+	return copyMessage(s.header, s.payload)
+}
+
 type simpleMessage struct {
-	tag      string
-	buffer   *bytes.Buffer
-	isSealed bool
-	sender   string
+	tag       string
+	id        string
+	timestamp time.Time
+	headers   map[string]string
+	buffer    *bytes.Buffer
+	isSealed  bool
+	sender    string
 }
 
 func (s simpleMessage) Tag() string {
@@ -43,6 +144,46 @@ func (s *simpleMessage) SetTag(tag string) {
 	s.tag = tag
 }
 
+func (s simpleMessage) ID() string {
+	return s.id
+}
+
+func (s *simpleMessage) SetID(id string) {
+	s.id = id
+}
+
+func (s simpleMessage) Timestamp() time.Time {
+	return s.timestamp
+}
+
+func (s *simpleMessage) SetTimestamp(timestamp time.Time) {
+	s.timestamp = timestamp
+}
+
+func (s simpleMessage) Sender() string {
+	return s.sender
+}
+
+func (s *simpleMessage) SetSender(sender string) {
+	s.sender = sender
+}
+
+func (s simpleMessage) Header(key string) string {
+	return s.headers[key]
+}
+
+func (s *simpleMessage) SetHeader(key, value string) {
+	s.headers[key] = value
+}
+
+func (s simpleMessage) Headers() map[string]string {
+	result := make(map[string]string, len(s.headers))
+	for key, value := range s.headers {
+		result[key] = value
+	}
+	return result
+}
+
 func (s *simpleMessage) Read(p []byte) (n int, err error) {
 	n, err = s.buffer.Read(p)
 	return n, err
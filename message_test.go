@@ -0,0 +1,68 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("Message", func() {
+	It("should have a unique ID", func() {
+		Expect(NewMessage("tag").ID()).ShouldNot(BeEmpty())
+		Expect(NewMessage("tag").ID()).ShouldNot(Equal(NewMessage("tag").ID()))
+	})
+
+	It("should keep headers after closing", func() {
+		message := NewMessage("tag")
+		message.Close()
+		message.SetHeader("trace", "abc")
+		Expect(message.Header("trace")).Should(Equal("abc"))
+		Expect(message.Header("missing")).Should(BeEmpty())
+
+		headers := message.Headers()
+		headers["trace"] = "changed"
+		Expect(message.Header("trace")).Should(Equal("abc"))
+	})
+
+	It("should copy the metadata", func() {
+		message := NewMessage("tag")
+		message.SetSender("sender")
+		message.SetTimestamp(time.Now())
+		message.SetHeader("trace", "abc")
+
+		result := copyMessage(message, []byte("payload"))
+		Expect(result.Tag()).Should(Equal("tag"))
+		Expect(result.ID()).Should(Equal(message.ID()))
+		Expect(result.Sender()).Should(Equal("sender"))
+		Expect(result.Timestamp()).Should(Equal(message.Timestamp()))
+		Expect(result.Headers()).Should(Equal(map[string]string{"trace": "abc"}))
+		Expect(payloadOf(result)).Should(Equal("payload"))
+	})
+
+	It("should be published with its metadata", func() {
+		pub := New()
+		sub := pub.Subscribe("tag", NewSubscriber)
+		message := NewMessage("tag")
+		message.SetSender("sender")
+		message.SetHeader("trace", "abc")
+		before := time.Now()
+		pub.Publish(message)
+
+		result := sub.WaitForMessage()
+		Expect(result.ID()).Should(Equal(message.ID()))
+		Expect(result.Sender()).Should(Equal("sender"))
+		Expect(result.Header("trace")).Should(Equal("abc"))
+		Expect(result.Timestamp()).ShouldNot(BeTemporally("<", before))
+		Expect(result.Timestamp()).Should(Equal(message.Timestamp()))
+	})
+
+	It("should keep the timestamp of a republished message", func() {
+		pub := New()
+		sub := pub.Subscribe("tag", NewSubscriber)
+		message := NewMessage("tag")
+		timestamp := time.Now().Add(-time.Hour)
+		message.SetTimestamp(timestamp)
+		pub.Publish(message)
+		Expect(sub.WaitForMessage().Timestamp()).Should(Equal(timestamp))
+	})
+})
@@ -1,100 +1,525 @@
 package pub
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+//  How long a registered connection is kept for StartConversation or
+//  AwaitConversation if MessengerConfig.PendingTimeout is zero.
+const DEFAULT_PENDING_TIMEOUT = time.Minute
+
+//  Connection IDs starting with this prefix are reserved for the tags the
+//  Messenger publishes itself, e.g. AUTH_FAILURE_TAG. Remotes that register
+//  such an ID are closed.
+const RESERVED_ID_PREFIX = "pub/"
+
 //  A Messenger provides methods to simply connect two parties who want
 //  to communicate. A Messenger can be used to transport a Publishers messages
-//  over the network, but also to stream more complex data.
+//  over the network (see ServePublisher and RemotePublisher), but also to
+//  stream more complex data.
+//
+//  Before anything else, both sides of a new connection exchange a greeting
+//  with their protocol version, the features they support and their identity.
+//  The resulting Connection uses the best protocol both sides understand, see
+//  Connection.Peer for the outcome.
+//
+//  A Messenger can talk to remotes and listen at several ports at the same
+//  time. All methods are safe for concurrent use.
 type Messenger interface {
+	//  Same as TalkOn with the network "tcp".
 	TalkTo(remote string) (Connection, error)
+
+	//  Connects to the address on the named network, see net.Dial. Use "unix"
+	//  to talk to a messenger that listens on a Unix domain socket.
+	TalkOn(network, address string) (Connection, error)
+
+	//  Same as ListenOn with the network "tcp" and the address ":port".
 	ListenAt(port int, publisher Publisher) error
+
+	//  Listens for remotes on the address of the named network, see
+	//  net.Listen: "tcp", "tcp4", "tcp6" or "unix". Returns the address that
+	//  was actually bound, e.g. the chosen port if the address had port 0.
+	//  Every registered connection is announced to the publisher by a
+	//  message tagged with its connection ID. IDs that start with
+	//  RESERVED_ID_PREFIX are refused, so the announcements can't be mistaken
+	//  for the messages of the Messenger itself.
+	ListenOn(network, address string, publisher Publisher) (net.Addr, error)
 	StartConversation(key string) (Connection, bool)
-	StopListening()
+
+	//  Blocks until a remote registered with the given connection ID and
+	//  returns its Connection, like StartConversation would. Returns the error
+	//  of the context if it is done before.
+	AwaitConversation(ctx context.Context, key string) (Connection, error)
+
+	//  Closes all listeners that were started by ListenAt or ListenOn and
+	//  returns once they stopped accepting connections. Connections that are
+	//  in the middle of their handshake are still registered. Returns the
+	//  first error of closing a listener.
+	StopListening() error
+
+	//  Stops listening like StopListening and waits until every connection
+	//  that was accepted completed its handshake and was claimed by
+	//  StartConversation or AwaitConversation. Once the context is done,
+	//  all connections that weren't claimed yet are closed and the error of
+	//  the context is returned. Pass a done context to close them right away.
+	Shutdown(ctx context.Context) error
+}
+
+//  MessengerConfig configures the Messenger created by NewMessengerWithConfig.
+type MessengerConfig struct {
+	//  The identity that is sent to the remote in the greeting.
+	Identity string
+
+	//  Don't offer the binary protocol, always use the text protocol.
+	DisableBinary bool
+
+	//  How long a registered connection waits to be claimed before it is
+	//  closed. Zero means DEFAULT_PENDING_TIMEOUT, a negative value keeps
+	//  connections until they are claimed.
+	PendingTimeout time.Duration
+
+	//  How long the handshake, authentication and registration of a
+	//  connection may take, so that a silent remote can't block it. Zero
+	//  means no limit.
+	HandshakeTimeout time.Duration
+
+	//  If set, all connections use TLS with this config. Listening requires
+	//  Certificates (or GetCertificate). To verify client certificates, set
+	//  ClientAuth to tls.RequireAndVerifyClientCert and ClientCAs. The
+	//  outcome is available by Connection.Peer.
+	TLS *tls.Config
+
+	//  If set, every remote has to authenticate before it can register and
+	//  this side authenticates when talking to a remote. Remotes that fail
+	//  are reported by a message tagged AUTH_FAILURE_TAG. Legacy clients
+	//  without greeting are rejected.
+	Authenticator Authenticator
+
+	//  If Heartbeat.Interval is positive, a Heartbeat is started for every
+	//  Connection whose remote supports it, see StartHeartbeat. Such
+	//  Connections must be read continuously.
+	Heartbeat HeartbeatOptions
 }
 
 func NewMessenger() Messenger {
-	return &messenger{connections: make(map[string]Connection)}
+	return NewMessengerWithConfig(MessengerConfig{})
+}
+
+func NewMessengerWithConfig(config MessengerConfig) Messenger {
+	if config.PendingTimeout == 0 {
+		config.PendingTimeout = DEFAULT_PENDING_TIMEOUT
+	}
+	return &messenger{
+		listeners:   make(map[string]*listener),
+		handshakes:  make(map[net.Conn]bool),
+		connections: make(map[string]*pendingConnection),
+		waiters:     make(map[string][]chan Connection),
+		config:      config,
+	}
 }
 
 type messenger struct {
-	port          int
-	isTalking     bool
-	isListening   bool
-	stopListening bool
-	connections   map[string]Connection //TODO: Mutex!
+	config      MessengerConfig
+	listeners   map[string]*listener
+	handshakes  map[net.Conn]bool
+	handlers    sync.WaitGroup
+	connections map[string]*pendingConnection
+	waiters     map[string][]chan Connection
+	idle        chan struct{}
+	sync.Mutex
+}
+
+//  A listener is started by ListenOn and stopped by StopListening. done is
+//  closed once its accept loop exited.
+type listener struct {
+	netListener net.Listener
+	done        chan struct{}
+}
+
+//  A pendingConnection is a registered connection that wasn't claimed yet.
+//  The timer closes it after MessengerConfig.PendingTimeout, if any.
+type pendingConnection struct {
+	conn   Connection
+	expiry *time.Timer
 }
 
 func (m *messenger) TalkTo(remote string) (Connection, error) {
-	if m.isListening {
-		return nil, errors.New("messenger can't listen and talk at the same time")
+	return m.TalkOn("tcp", remote)
+}
+
+func (m *messenger) TalkOn(network, address string) (Connection, error) {
+	conn, err := m.dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	m.limitHandshake(conn)
+	result, reply, err := clientHandshake(conn, m.hello())
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
-	conn, err := net.Dial("tcp", remote)
+	err = m.matchAuthentication(reply.auth)
 	if err != nil {
+		result.Close()
 		return nil, err
 	}
-	m.isTalking = true
-	return NewConnection(conn), nil
+	if m.config.Authenticator != nil {
+		err = m.prove(result)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	m.startHeartbeat(result)
+	return result, nil
 }
 
-func (m *messenger) ListenAt(port int, publisher Publisher) error {
-	if m.isTalking {
-		return errors.New("messenger can't listen and talk at the same time")
+func (m *messenger) limitHandshake(conn net.Conn) {
+	if m.config.HandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(m.config.HandshakeTimeout))
 	}
-	m.isListening = true
-	m.port = port
-	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+}
+
+func (m *messenger) startHeartbeat(conn Connection) {
+	if m.config.Heartbeat.Interval > 0 && conn.Peer().Supports(FEATURE_HEARTBEAT) {
+		StartHeartbeat(conn, m.config.Heartbeat)
+	}
+}
+
+//  Returns an error if the remote requires another authentication method than
+//  the one of the Authenticator, or none at all.
+func (m *messenger) matchAuthentication(remote string) error {
+	local := m.authMethod()
+	switch {
+	case local == remote:
+		return nil
+	case local == "":
+		return fmt.Errorf("remote requires %q authentication, but no Authenticator is configured", remote)
+	case remote == "":
+		return fmt.Errorf("remote doesn't accept authentication, but the Authenticator uses %q", local)
+	default:
+		return fmt.Errorf("remote requires %q authentication, but the Authenticator uses %q", remote, local)
+	}
+}
+
+func (m *messenger) authMethod() string {
+	if m.config.Authenticator == nil {
+		return ""
+	}
+	return m.config.Authenticator.Method()
+}
+
+//  Authenticates at the remote and waits for its verdict.
+func (m *messenger) prove(conn Connection) error {
+	err := m.config.Authenticator.Prove(conn, m.config.Identity)
 	if err != nil {
 		return err
 	}
-	go func() {
-		for {
-			conn, err := listener.Accept()
-			if err != nil {
-				return
-			}
-			if m.stopListening {
-				conn.Close()
-				listener.Close()
-				return
-			}
-			go m.handleNewConnection(conn, publisher)
-		}
-	}()
+	verdict, err := conn.ReceiveString()
+	if err != nil {
+		return err
+	}
+	if verdict != AUTH_OK {
+		return ErrAuthenticationFailed
+	}
 	return nil
 }
 
+func (m *messenger) dial(network, address string) (net.Conn, error) {
+	if m.config.TLS == nil {
+		return net.Dial(network, address)
+	}
+	conn, err := tls.Dial(network, address, m.config.TLS)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (m *messenger) hello() hello {
+	features := []string{FEATURE_HEARTBEAT}
+	if !m.config.DisableBinary {
+		features = append(features, FEATURE_BINARY)
+	}
+	return hello{version: PROTOCOL_VERSION, identity: m.config.Identity, features: features, auth: m.authMethod()}
+}
+
+func (m *messenger) ListenAt(port int, publisher Publisher) error {
+	_, err := m.ListenOn("tcp", ":"+strconv.Itoa(port), publisher)
+	return err
+}
+
+func (m *messenger) ListenOn(network, address string, publisher Publisher) (net.Addr, error) {
+	m.Lock()
+	defer m.Unlock()
+	netListener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if m.config.TLS != nil {
+		netListener = tls.NewListener(netListener, m.config.TLS)
+	}
+	current := &listener{netListener: netListener, done: make(chan struct{})}
+	m.listeners[network+" "+netListener.Addr().String()] = current
+	go m.accept(current, publisher)
+	return netListener.Addr(), nil
+}
+
+//  Accepts connections until the listener is closed.
+func (m *messenger) accept(current *listener, publisher Publisher) {
+	defer close(current.done)
+	for {
+		conn, err := current.netListener.Accept()
+		if err != nil {
+			return
+		}
+		m.Lock()
+		m.handshakes[conn] = true
+		m.handlers.Add(1)
+		m.Unlock()
+		go m.handleNewConnection(conn, publisher)
+	}
+}
+
 func (m *messenger) handleNewConnection(conn net.Conn, publisher Publisher) {
-	newConn := NewConnection(conn)
-	connId, err := newConn.ReceiveString()
+	defer m.handlers.Done()
+	defer m.finishHandshake(conn)
+	m.limitHandshake(conn)
+	newConn, connId, err := serverHandshake(conn, m.hello())
 	if err != nil {
+		conn.Close()
+		return
+	}
+	if m.config.Authenticator != nil {
+		if connId != "" {
+			err = errors.New("legacy clients can't authenticate")
+		} else {
+			err = m.verify(newConn)
+		}
+		if err != nil {
+			newConn.Close()
+			m.reportAuthFailure(conn, newConn.Peer(), err, publisher)
+			return
+		}
+	}
+	if connId == "" {
+		connId, err = newConn.ReceiveString()
+		if err != nil {
+			newConn.Close()
+			return
+		}
+	}
+	if strings.HasPrefix(connId, RESERVED_ID_PREFIX) {
 		newConn.Close()
 		return
 	}
+	conn.SetDeadline(time.Time{})
+	m.startHeartbeat(newConn)
+	m.register(connId, newConn)
 	notification := NewMessage(connId)
 	notification.Write([]byte("READY"))
 	publisher.Publish(notification)
-	m.connections[connId] = newConn
 }
 
-func (m *messenger) StartConversation(key string) (Connection, bool) {
-	result, ok := m.connections[key]
-	if ok {
-		delete(m.connections, key)
+//  Verifies the remote, tells it the verdict and records the authenticated
+//  identity in its Peer.
+func (m *messenger) verify(conn Connection) error {
+	identity, err := m.config.Authenticator.Verify(conn)
+	if err != nil {
+		conn.SendString(AUTH_DENIED)
+		return err
 	}
-	return result, ok
+	err = conn.SendString(AUTH_OK)
+	if err != nil {
+		return err
+	}
+	peer := conn.Peer()
+	peer.Identity = identity
+	peer.Authenticated = true
+	conn.(interface{ setPeer(Peer) }).setPeer(peer)
+	return nil
 }
 
-func (m *messenger) StopListening() {
-	if !m.isListening {
+func (m *messenger) reportAuthFailure(conn net.Conn, peer Peer, reason error, publisher Publisher) {
+	failure := NewMessage(AUTH_FAILURE_TAG)
+	failure.SetHeader(AUTH_ADDRESS_HEADER, conn.RemoteAddr().String())
+	failure.SetHeader(AUTH_IDENTITY_HEADER, peer.Identity)
+	failure.Write([]byte(reason.Error()))
+	publisher.Publish(failure)
+}
+
+func (m *messenger) finishHandshake(conn net.Conn) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.handshakes, conn)
+}
+
+//  Hands the connection to the first caller of AwaitConversation that waits
+//  for the ID or registers it until it is claimed or expires. An unclaimed
+//  connection that was registered with the same ID before is closed.
+func (m *messenger) register(connId string, conn Connection) {
+	m.Lock()
+	defer m.Unlock()
+	if waiters := m.waiters[connId]; len(waiters) > 0 {
+		waiters[0] <- conn
+		m.removeWaiter(connId, waiters[0])
 		return
 	}
-	m.stopListening = true
-	conn, err := net.Dial("tcp", "localhost:"+strconv.Itoa(m.port))
-	if err != nil {
+	if previous, ok := m.claim(connId); ok {
+		previous.Close()
+	}
+	pending := &pendingConnection{conn: conn}
+	if m.config.PendingTimeout > 0 {
+		pending.expiry = time.AfterFunc(m.config.PendingTimeout, func() {
+			m.expire(connId, pending)
+		})
+	}
+	m.connections[connId] = pending
+}
+
+//  Closes the connection if it is still unclaimed.
+func (m *messenger) expire(connId string, pending *pendingConnection) {
+	m.Lock()
+	defer m.Unlock()
+	if m.connections[connId] == pending {
+		m.claim(connId)
+		pending.conn.Close()
+	}
+}
+
+//  Removes and returns the registered connection. The caller must hold the lock.
+func (m *messenger) claim(key string) (Connection, bool) {
+	pending, ok := m.connections[key]
+	if !ok {
+		return nil, false
+	}
+	if pending.expiry != nil {
+		pending.expiry.Stop()
+	}
+	delete(m.connections, key)
+	if len(m.connections) == 0 && m.idle != nil {
+		close(m.idle)
+		m.idle = nil
+	}
+	return pending.conn, true
+}
+
+func (m *messenger) removeWaiter(key string, waiter chan Connection) {
+	waiters := m.waiters[key]
+	for i := range waiters {
+		if waiters[i] == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(m.waiters, key)
+	} else {
+		m.waiters[key] = waiters
+	}
+}
+
+func (m *messenger) StartConversation(key string) (Connection, bool) {
+	m.Lock()
+	defer m.Unlock()
+	return m.claim(key)
+}
+
+func (m *messenger) AwaitConversation(ctx context.Context, key string) (Connection, error) {
+	m.Lock()
+	if result, ok := m.claim(key); ok {
+		m.Unlock()
+		return result, nil
+	}
+	waiter := make(chan Connection, 1)
+	m.waiters[key] = append(m.waiters[key], waiter)
+	m.Unlock()
+
+	select {
+	case result := <-waiter:
+		return result, nil
+	case <-ctx.Done():
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	select {
+	case result := <-waiter:
+		return result, nil
+	default:
+		m.removeWaiter(key, waiter)
+		return nil, ctx.Err()
+	}
+}
+
+func (m *messenger) StopListening() error {
+	m.Lock()
+	listeners := m.listeners
+	m.listeners = make(map[string]*listener)
+	m.Unlock()
+
+	var err error
+	for _, current := range listeners {
+		closeErr := current.netListener.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	for _, current := range listeners {
+		<-current.done
+	}
+	return err
+}
+
+func (m *messenger) Shutdown(ctx context.Context) error {
+	err := m.StopListening()
+
+	handshakes := make(chan struct{})
+	go func() {
+		m.handlers.Wait()
+		close(handshakes)
+	}()
+	select {
+	case <-handshakes:
+	case <-ctx.Done():
+	}
+	for ctx.Err() == nil {
+		m.Lock()
+		if len(m.connections) == 0 {
+			m.Unlock()
+			break
+		}
+		if m.idle == nil {
+			m.idle = make(chan struct{})
+		}
+		idle := m.idle
+		m.Unlock()
+		select {
+		case <-idle:
+		case <-ctx.Done():
+		}
+	}
+
+	m.Lock()
+	for conn := range m.handshakes {
+		conn.Close()
+	}
+	for connId := range m.connections {
+		conn, _ := m.claim(connId)
 		conn.Close()
 	}
+	m.Unlock()
+	if err == nil {
+		err = ctx.Err()
+	}
+	return err
 }
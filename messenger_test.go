@@ -0,0 +1,588 @@
+package pub
+
+import (
+	"context"
+	"crypto/tls"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Messenger", func() {
+	var server Messenger
+	var notifications Publisher
+	var address string
+
+	BeforeEach(func() {
+		currentPort := int(rand.Int31n(100)) + 9100
+		address = "127.0.0.1:" + strconv.Itoa(currentPort)
+		notifications = New()
+		server = NewMessengerWithConfig(MessengerConfig{Identity: "server"})
+		Expect(server.ListenAt(currentPort, notifications)).Should(Succeed())
+	})
+
+	AfterEach(func() {
+		server.StopListening()
+	})
+
+	awaitConversation := func(connId string) Connection {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result, err := server.AwaitConversation(ctx, connId)
+		Expect(err).Should(Succeed())
+		return result
+	}
+
+	Context("handshake", func() {
+		It("should negotiate the binary protocol", func() {
+			client := NewMessengerWithConfig(MessengerConfig{Identity: "client"})
+			clientConn, err := client.TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.Peer()).Should(Equal(Peer{Identity: "server", Version: PROTOCOL_VERSION, Features: []string{FEATURE_HEARTBEAT, FEATURE_BINARY}}))
+			Expect(clientConn.SendString("binary")).Should(Succeed())
+
+			serverConn := awaitConversation("binary")
+			defer serverConn.Close()
+			Expect(serverConn.Peer()).Should(Equal(Peer{Identity: "client", Version: PROTOCOL_VERSION, Features: []string{FEATURE_HEARTBEAT, FEATURE_BINARY}}))
+
+			message := NewMessage("tag")
+			message.Write([]byte("no newline"))
+			Expect(clientConn.SendMessage(message)).Should(Succeed())
+			result, err := serverConn.ReceiveMessage()
+			Expect(err).Should(Succeed())
+			Expect(ioutil.ReadAll(result)).Should(Equal([]byte("no newline")))
+		})
+
+		It("should fall back to the text protocol", func() {
+			client := NewMessengerWithConfig(MessengerConfig{DisableBinary: true})
+			clientConn, err := client.TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.Peer().Features).Should(Equal([]string{FEATURE_HEARTBEAT}))
+			Expect(clientConn.SendString("text")).Should(Succeed())
+
+			serverConn := awaitConversation("text")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Supports(FEATURE_BINARY)).Should(BeFalse())
+
+			message := NewMessage("tag")
+			message.Write([]byte("no newline"))
+			Expect(serverConn.SendMessage(message)).Should(Succeed())
+			result, err := clientConn.ReceiveMessage()
+			Expect(err).Should(Succeed())
+			Expect(ioutil.ReadAll(result)).Should(Equal([]byte("no newline\n")))
+		})
+
+		It("should accept legacy clients without greeting", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).Should(Succeed())
+			legacyConn := NewConnection(conn)
+			defer legacyConn.Close()
+			Expect(legacyConn.SendString("legacy")).Should(Succeed())
+
+			serverConn := awaitConversation("legacy")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Version).Should(Equal(LEGACY_PROTOCOL_VERSION))
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(legacyConn.ReceiveString()).Should(Equal("hello"))
+		})
+
+		It("should send messages without metadata to legacy clients", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			text := textproto.NewConn(conn)
+			Expect(text.PrintfLine("%d %s", STRING, "legacy-message")).Should(Succeed())
+
+			serverConn := awaitConversation("legacy-message")
+			defer serverConn.Close()
+			message := NewMessage("tag")
+			message.SetSender("server")
+			message.SetHeader("key", "value")
+			message.Write([]byte("payload"))
+			Expect(serverConn.SendMessage(message)).Should(Succeed())
+
+			//	A legacy client expects nothing but the tag, the lines and the end.
+			for _, expected := range []int{MESSAGE_TAG, MESSAGE_LINE, MESSAGE_END} {
+				_, _, err := text.ReadCodeLine(expected)
+				Expect(err).Should(Succeed())
+			}
+		})
+
+		It("should negotiate the lower version and common features", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			text := textproto.NewConn(conn)
+			future := hello{version: PROTOCOL_VERSION + 1, identity: "future", features: []string{"compression", FEATURE_BINARY}}
+			Expect(text.PrintfLine("%d %s", HELLO, future.encode())).Should(Succeed())
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, line, err := text.ReadCodeLine(HELLO_REPLY)
+			Expect(err).Should(Succeed())
+			reply, err := parseHello(line)
+			Expect(err).Should(Succeed())
+			Expect(reply.version).Should(Equal(PROTOCOL_VERSION))
+			Expect(reply.features).Should(Equal([]string{FEATURE_BINARY}))
+		})
+	})
+
+	Context("concurrency", func() {
+		It("should register and hand out many connections at once", func() {
+			const clients = 50
+			var wg sync.WaitGroup
+			clientConns := make(chan Connection, clients)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					client := NewMessenger()
+					conn, err := client.TalkTo(address)
+					Expect(err).Should(Succeed())
+					Expect(conn.SendString("stress-" + strconv.Itoa(i))).Should(Succeed())
+					clientConns <- conn
+				}(i)
+			}
+
+			serverConns := make(chan Connection, clients)
+			for i := 0; i < clients; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					defer GinkgoRecover()
+					serverConns <- awaitConversation("stress-" + strconv.Itoa(i))
+				}(i)
+			}
+			wg.Wait()
+			close(clientConns)
+			close(serverConns)
+
+			Expect(serverConns).Should(HaveLen(clients))
+			for conn := range serverConns {
+				conn.Close()
+			}
+			for conn := range clientConns {
+				conn.Close()
+			}
+		})
+
+		It("should hand out a connection only once", func() {
+			client := NewMessenger()
+			conn, err := client.TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			ready := notifications.Subscribe("once", NewChanSubscriber).(ChanSubscriber).Messages()
+			Expect(conn.SendString("once")).Should(Succeed())
+			Eventually(ready).Should(Receive())
+
+			var wg sync.WaitGroup
+			var lock sync.Mutex
+			claimed := 0
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if serverConn, ok := server.StartConversation("once"); ok {
+						lock.Lock()
+						claimed++
+						lock.Unlock()
+						serverConn.Close()
+					}
+				}()
+			}
+			wg.Wait()
+			Expect(claimed).Should(Equal(1))
+		})
+
+		It("should close an unclaimed connection that is replaced", func() {
+			first, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer first.Close()
+			Expect(first.SendString("twice")).Should(Succeed())
+			second, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer second.Close()
+
+			ready := notifications.Subscribe("twice", NewChanSubscriber).(ChanSubscriber).Messages()
+			Expect(second.SendString("twice")).Should(Succeed())
+			Eventually(ready).Should(Receive())
+
+			_, err = first.ReceiveString()
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should survive concurrent stops", func() {
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					server.StopListening()
+				}()
+			}
+			wg.Wait()
+		})
+	})
+
+	Context("awaiting conversations", func() {
+		It("should wait until the remote registered", func() {
+			result := make(chan Connection, 1)
+			go func() {
+				defer GinkgoRecover()
+				result <- awaitConversation("later")
+			}()
+			Consistently(result).ShouldNot(Receive())
+
+			clientConn, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString("later")).Should(Succeed())
+
+			var serverConn Connection
+			Eventually(result).Should(Receive(&serverConn))
+			defer serverConn.Close()
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(clientConn.ReceiveString()).Should(Equal("hello"))
+			_, ok := server.StartConversation("later")
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should return a connection that registered before", func() {
+			clientConn, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			ready := notifications.Subscribe("before", NewChanSubscriber).(ChanSubscriber).Messages()
+			Expect(clientConn.SendString("before")).Should(Succeed())
+			Eventually(ready).Should(Receive())
+
+			serverConn := awaitConversation("before")
+			defer serverConn.Close()
+		})
+
+		It("should stop waiting when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			result, err := server.AwaitConversation(ctx, "never")
+			Expect(err).Should(Equal(context.DeadlineExceeded))
+			Expect(result).Should(BeNil())
+		})
+
+		It("should close connections that are never claimed", func() {
+			port := int(rand.Int31n(100)) + 9200
+			expiring := NewMessengerWithConfig(MessengerConfig{PendingTimeout: 50 * time.Millisecond})
+			Expect(expiring.ListenAt(port, New())).Should(Succeed())
+			defer expiring.StopListening()
+
+			clientConn, err := NewMessenger().TalkTo("127.0.0.1:" + strconv.Itoa(port))
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString("abandoned")).Should(Succeed())
+
+			_, err = clientConn.ReceiveString()
+			Expect(err).Should(HaveOccurred())
+			_, ok := expiring.StartConversation("abandoned")
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should close connections that stall the handshake", func() {
+			impatient := NewMessengerWithConfig(MessengerConfig{HandshakeTimeout: 50 * time.Millisecond})
+			bound, err := impatient.ListenOn("tcp", "127.0.0.1:0", New())
+			Expect(err).Should(Succeed())
+			defer impatient.StopListening()
+
+			conn, err := net.Dial("tcp", bound.String())
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = ioutil.ReadAll(conn)
+			Expect(err).Should(Succeed())
+		})
+	})
+
+	Context("listening and talking", func() {
+		It("should talk while listening", func() {
+			clientConn, err := server.TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString("self")).Should(Succeed())
+
+			serverConn := awaitConversation("self")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Identity).Should(Equal("server"))
+		})
+
+		It("should refuse reserved connection IDs", func() {
+			failures := notifications.Subscribe(AUTH_FAILURE_TAG, NewChanSubscriber).(ChanSubscriber)
+			clientConn, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString(AUTH_FAILURE_TAG)).Should(Succeed())
+
+			_, err = clientConn.ReceiveString()
+			Expect(err).Should(HaveOccurred())
+			Consistently(failures.Messages()).ShouldNot(Receive())
+			_, ok := server.StartConversation(AUTH_FAILURE_TAG)
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should listen while talking", func() {
+			peer := NewMessenger()
+			clientConn, err := peer.TalkTo(address)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+
+			port := int(rand.Int31n(100)) + 9300
+			Expect(peer.ListenAt(port, New())).Should(Succeed())
+			defer peer.StopListening()
+		})
+
+		It("should listen at several ports", func() {
+			port := int(rand.Int31n(100)) + 9400
+			Expect(server.ListenAt(port, notifications)).Should(Succeed())
+			Expect(server.ListenAt(port, notifications)).ShouldNot(Succeed())
+
+			for _, current := range []string{address, "127.0.0.1:" + strconv.Itoa(port)} {
+				clientConn, err := NewMessenger().TalkTo(current)
+				Expect(err).Should(Succeed())
+				Expect(clientConn.SendString(current)).Should(Succeed())
+				serverConn := awaitConversation(current)
+				serverConn.Close()
+				clientConn.Close()
+			}
+
+			server.StopListening()
+			Eventually(func() error {
+				conn, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+				if err == nil {
+					conn.Close()
+				}
+				return err
+			}).Should(HaveOccurred())
+		})
+	})
+
+	Context("addresses", func() {
+		talkOn := func(network string, address net.Addr) {
+			clientConn, err := NewMessenger().TalkOn(network, address.String())
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString(network)).Should(Succeed())
+			serverConn := awaitConversation(network)
+			defer serverConn.Close()
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(clientConn.ReceiveString()).Should(Equal("hello"))
+		}
+
+		It("should report the bound port", func() {
+			bound, err := server.ListenOn("tcp", "127.0.0.1:0", notifications)
+			Expect(err).Should(Succeed())
+			Expect(bound.(*net.TCPAddr).Port).ShouldNot(BeZero())
+			talkOn("tcp", bound)
+		})
+
+		It("should listen on IPv6", func() {
+			bound, err := server.ListenOn("tcp6", "[::1]:0", notifications)
+			if err != nil {
+				Skip("IPv6 is not available: " + err.Error())
+			}
+			talkOn("tcp6", bound)
+		})
+
+		It("should listen on Unix domain sockets", func() {
+			dir, err := ioutil.TempDir("", "pub")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, "messenger.sock")
+
+			bound, err := server.ListenOn("unix", path, notifications)
+			Expect(err).Should(Succeed())
+			Expect(bound.String()).Should(Equal(path))
+			talkOn("unix", bound)
+
+			server.StopListening()
+			Eventually(func() error {
+				_, err := os.Stat(path)
+				return err
+			}).ShouldNot(Succeed())
+		})
+	})
+
+	Context("stopping", func() {
+		register := func(connId string) Connection {
+			clientConn, err := NewMessenger().TalkTo(address)
+			Expect(err).Should(Succeed())
+			ready := notifications.Subscribe(connId, NewChanSubscriber).(ChanSubscriber).Messages()
+			Expect(clientConn.SendString(connId)).Should(Succeed())
+			Eventually(ready).Should(Receive())
+			return clientConn
+		}
+
+		It("should close the listener before returning", func() {
+			Expect(server.StopListening()).Should(Succeed())
+			_, err := net.Dial("tcp", address)
+			Expect(err).Should(HaveOccurred())
+			Expect(server.StopListening()).Should(Succeed())
+		})
+
+		It("should keep registered connections", func() {
+			clientConn := register("kept")
+			defer clientConn.Close()
+			Expect(server.StopListening()).Should(Succeed())
+
+			serverConn := awaitConversation("kept")
+			defer serverConn.Close()
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(clientConn.ReceiveString()).Should(Equal("hello"))
+		})
+
+		It("should close unclaimed connections on shutdown", func() {
+			clientConn := register("unclaimed")
+			defer clientConn.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			Expect(server.Shutdown(ctx)).Should(Equal(context.Canceled))
+			_, err := clientConn.ReceiveString()
+			Expect(err).Should(HaveOccurred())
+			_, ok := server.StartConversation("unclaimed")
+			Expect(ok).Should(BeFalse())
+		})
+
+		It("should wait until registered connections are claimed", func() {
+			clientConn := register("drained")
+			defer clientConn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			result := make(chan error, 1)
+			go func() {
+				result <- server.Shutdown(ctx)
+			}()
+			Consistently(result).ShouldNot(Receive())
+
+			serverConn := awaitConversation("drained")
+			defer serverConn.Close()
+			Eventually(result).Should(Receive(BeNil()))
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(clientConn.ReceiveString()).Should(Equal("hello"))
+		})
+
+		It("should close connections that don't finish their handshake", func() {
+			conn, err := net.Dial("tcp", address)
+			Expect(err).Should(Succeed())
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(server.Shutdown(ctx)).Should(Equal(context.DeadlineExceeded))
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).Should(Equal(io.EOF))
+		})
+	})
+
+	Context("TLS", func() {
+		var certificates testCertificates
+		var tlsAddress string
+
+		BeforeEach(func() {
+			certificates = newTestCertificates()
+			tlsAddress = "127.0.0.1:" + strconv.Itoa(int(rand.Int31n(100))+9500)
+		})
+
+		listen := func(config *tls.Config) Messenger {
+			result := NewMessengerWithConfig(MessengerConfig{Identity: "tls-server", TLS: config})
+			_, err := result.ListenOn("tcp", tlsAddress, notifications)
+			Expect(err).Should(Succeed())
+			return result
+		}
+
+		awaitTLSConversation := func(messenger Messenger, connId string) Connection {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			result, err := messenger.AwaitConversation(ctx, connId)
+			Expect(err).Should(Succeed())
+			return result
+		}
+
+		It("should encrypt the connection", func() {
+			tlsServer := listen(&tls.Config{Certificates: []tls.Certificate{certificates.server}})
+			defer tlsServer.StopListening()
+
+			client := NewMessengerWithConfig(MessengerConfig{TLS: &tls.Config{RootCAs: certificates.pool}})
+			clientConn, err := client.TalkTo(tlsAddress)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.Peer().TLS).ShouldNot(BeNil())
+			Expect(clientConn.Peer().Certificate().Subject.CommonName).Should(Equal("server"))
+			Expect(clientConn.Peer().Supports(FEATURE_BINARY)).Should(BeTrue())
+			Expect(clientConn.SendString("encrypted")).Should(Succeed())
+
+			serverConn := awaitTLSConversation(tlsServer, "encrypted")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().TLS).ShouldNot(BeNil())
+			Expect(serverConn.Peer().Certificate()).Should(BeNil())
+			Expect(serverConn.SendString("hello")).Should(Succeed())
+			Expect(clientConn.ReceiveString()).Should(Equal("hello"))
+		})
+
+		It("should reject servers with untrusted certificates", func() {
+			tlsServer := listen(&tls.Config{Certificates: []tls.Certificate{certificates.server}})
+			defer tlsServer.StopListening()
+
+			_, err := NewMessengerWithConfig(MessengerConfig{TLS: &tls.Config{}}).TalkTo(tlsAddress)
+			Expect(err).Should(HaveOccurred())
+		})
+
+		It("should verify client certificates", func() {
+			tlsServer := listen(&tls.Config{
+				Certificates: []tls.Certificate{certificates.server},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    certificates.pool,
+			})
+			defer tlsServer.StopListening()
+
+			client := NewMessengerWithConfig(MessengerConfig{TLS: &tls.Config{
+				RootCAs:      certificates.pool,
+				Certificates: []tls.Certificate{certificates.client},
+			}})
+			clientConn, err := client.TalkTo(tlsAddress)
+			Expect(err).Should(Succeed())
+			defer clientConn.Close()
+			Expect(clientConn.SendString("mutual")).Should(Succeed())
+
+			serverConn := awaitTLSConversation(tlsServer, "mutual")
+			defer serverConn.Close()
+			Expect(serverConn.Peer().Certificate().Subject.CommonName).Should(Equal("client"))
+		})
+
+		It("should reject clients without certificate", func() {
+			tlsServer := listen(&tls.Config{
+				Certificates: []tls.Certificate{certificates.server},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    certificates.pool,
+			})
+			defer tlsServer.StopListening()
+
+			client := NewMessengerWithConfig(MessengerConfig{TLS: &tls.Config{RootCAs: certificates.pool}})
+			clientConn, err := client.TalkTo(tlsAddress)
+			if err == nil {
+				// With TLS 1.3, the client only learns about the rejection on its next read.
+				_, err = clientConn.ReceiveString()
+				clientConn.Close()
+			}
+			Expect(err).Should(HaveOccurred())
+		})
+	})
+})
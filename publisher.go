@@ -1,79 +1,425 @@
 package pub
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"io"
+	"io/ioutil"
+	"sort"
 	"sync"
+	"time"
 )
 
-//  A Publisher can publish messages to different subscribers.
+//  How long Close waits for a Subscriber to receive the next message before it
+//  closes the subscribers.
+const CLOSE_STALL_TIMEOUT = time.Second
+
+var ErrPublisherClosed = errors.New("publisher is closed")
+
+//  A Publisher can publish messages to different subscribers. Subscribers
+//  subscribe to a tag pattern that may contain wildcards, see MatchTag for the
+//  matching rules. A message is delivered once per matching subscription.
+//  Every Subscriber receives its messages one after another in the order in
+//  which they were published, even across different tags.
 type Publisher interface {
-	Publish(message Message)
+	//  Publishes the message to all matching subscriptions. Returns
+	//  ErrPublisherClosed if the Publisher is closed.
+	Publish(message Message) error
+
+	//  Subscribes a new Subscriber created by subCreater to the tag pattern.
+	//  After the Publisher was closed, the new Subscriber is closed right away.
 	Subscribe(tag string, subCreater func() Subscriber) Subscriber
+
 	Unsubscribe(tag string, subscriber Subscriber)
+
+	//  Publishes the message like Publish and retains it as the last value of
+	//  its tag. Every later subscription whose pattern matches the tag
+	//  first receives the retained value. A retained value is replaced by the
+	//  next retained message of the same tag.
+	PublishRetained(message Message) error
+
+	//  Removes the retained value of the tag, if any.
+	ClearRetained(tag string)
+
+	//  Like Subscribe, but the new Subscriber first receives all messages of
+	//  matching tags from the history that were published at or after since,
+	//  in publish order. Live delivery continues right after the replayed
+	//  messages without gaps or duplicates. Retained values are only delivered
+	//  for tags that had no replayed message. Without history, SubscribeFrom
+	//  behaves like Subscribe.
+	SubscribeFrom(tag string, since time.Time, subCreater func() Subscriber) Subscriber
+
+	//  Same as Drain without a deadline, but gives up once no Subscriber
+	//  received a message for CLOSE_STALL_TIMEOUT, e.g. because nobody reads
+	//  from a full Subscriber. The subscribers are closed then, which releases
+	//  the blocked deliveries and discards the remaining messages.
+	Close() error
+
+	//  Stops accepting new messages, waits until all published messages were
+	//  received by the subscribers and then closes every Subscriber that
+	//  implements io.Closer, e.g. the Subscribers included in pub. If the context
+	//  is done before, the subscribers are closed anyway and the error of the
+	//  context is returned. Returns ErrPublisherClosed if already closed.
+	Drain(ctx context.Context) error
+}
+
+//  PublisherOptions configure the Publisher created by NewWithOptions.
+type PublisherOptions struct {
+	//  How many messages per tag are kept for SubscribeFrom.
+	HistorySize int
+
+	//  How long messages are kept for SubscribeFrom. The history of a tag is
+	//  removed once all of its messages expired. Without HistoryAge, the last
+	//  messages of every tag are kept for good.
+	HistoryAge time.Duration
 }
 
 type publisher struct {
-	subscribers map[string][]Subscriber
+	subscriptions *tagTrie
+	queues        map[Subscriber]*subscriberQueue
+	retained      map[string]storedMessage
+	history       map[string]*historyRing
+	pruned        time.Time
+	sequence      uint64
+	options       PublisherOptions
+	closed        bool
 	sync.RWMutex
 }
 
+type subscription struct {
+	pattern    string
+	subscriber Subscriber
+	queue      *deliveryQueue
+}
+
+//  A subscriberQueue is shared by all subscriptions of the same Subscriber, so
+//  that the Subscriber sees the global publish order.
+type subscriberQueue struct {
+	queue         *deliveryQueue
+	subscriptions int
+}
+
+//  Returns a Publisher without history.
 func New() Publisher {
-	subs := make(map[string][]Subscriber)
+	return NewWithOptions(PublisherOptions{})
+}
+
+//  Returns a Publisher configured by the given options. If HistorySize or
+//  HistoryAge is positive, the Publisher keeps a history per tag that is
+//  limited by both of them.
+func NewWithOptions(options PublisherOptions) Publisher {
 	result := publisher{
-		subscribers: subs,
+		subscriptions: newTagTrie(),
+		queues:        make(map[Subscriber]*subscriberQueue),
+		retained:      make(map[string]storedMessage),
+		history:       make(map[string]*historyRing),
+		options:       options,
 	}
 	return &result
 }
 
-func (p *publisher) Publish(message Message) {
+func (p *publisher) Publish(message Message) error {
+	return p.publish(message, false)
+}
+
+func (p *publisher) PublishRetained(message Message) error {
+	return p.publish(message, true)
+}
+
+func (p *publisher) publish(message Message, retain bool) error {
 	p.Lock()
 	defer p.Unlock()
+	if p.closed {
+		return ErrPublisherClosed
+	}
 	message.Close()
+	if message.Timestamp().IsZero() {
+		message.SetTimestamp(time.Now())
+	}
+
+	if !retain && !p.hasHistory() {
+		p.publishLocal(message, message)
+		return nil
+	}
+
+	payload, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	if retain {
+		p.retained[message.Tag()] = newStoredMessage(message, payload)
+	}
+	if p.hasHistory() {
+		p.record(message, payload)
+	}
+	p.publishLocal(message, bytes.NewReader(payload))
+	return nil
+}
+
+func (p *publisher) hasHistory() bool {
+	return p.options.HistorySize > 0 || p.options.HistoryAge > 0
+}
+
+func (p *publisher) record(message Message, payload []byte) {
+	ring, ok := p.history[message.Tag()]
+	if !ok {
+		ring = newHistoryRing(p.options.HistorySize, p.options.HistoryAge)
+		p.history[message.Tag()] = ring
+	}
+	p.sequence++
+	now := time.Now()
+	ring.add(historyEntry{
+		sequence:      p.sequence,
+		published:     now,
+		storedMessage: newStoredMessage(message, payload),
+	})
+	p.pruneHistory(now)
+}
+
+//  Removes the history of tags whose messages all expired. Runs at most once
+//  per HistoryAge, so that publishing doesn't walk all tags every time.
+func (p *publisher) pruneHistory(now time.Time) {
+	if p.options.HistoryAge <= 0 || now.Sub(p.pruned) < p.options.HistoryAge {
+		return
+	}
+	p.pruned = now
+	for tag, ring := range p.history {
+		ring.expire(now)
+		if ring.count == 0 {
+			delete(p.history, tag)
+		}
+	}
+}
+
+//  Queues the history entries of all tags matching the pattern in publish
+//  order. Returns the tags that had at least one entry.
+func (p *publisher) deliverHistory(pattern string, since time.Time, queue *deliveryQueue) map[string]bool {
+	entries := make([]historyEntry, 0)
+	replayed := make(map[string]bool)
+	for tag, ring := range p.history {
+		if !MatchTag(pattern, tag) {
+			continue
+		}
+		for _, entry := range ring.since(since) {
+			entries = append(entries, entry)
+			replayed[tag] = true
+		}
+		if ring.count == 0 {
+			delete(p.history, tag)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].sequence < entries[j].sequence
+	})
+	for _, entry := range entries {
+		queue.push(entry.message())
+	}
+	return replayed
+}
+
+func (p *publisher) ClearRetained(tag string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.retained, tag)
+}
 
-	p.publishLocal(message.Tag(), message)
+//  Queues the retained values of all tags matching the pattern, sorted by tag.
+//  Tags in skip are left out.
+func (p *publisher) deliverRetained(pattern string, queue *deliveryQueue, skip map[string]bool) {
+	tags := make([]string, 0)
+	for tag := range p.retained {
+		if MatchTag(pattern, tag) && !skip[tag] {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	for _, tag := range tags {
+		queue.push(p.retained[tag].message())
+	}
 }
 
-func (p *publisher) publishLocal(tag string, payload io.Reader) {
-	if subs, ok := p.subscribers[tag]; ok {
+//  Delivers a copy of the message with the given payload to every matching
+//  subscription. The copies share the tag and the metadata of the message.
+func (p *publisher) publishLocal(message Message, payload io.Reader) {
+	tag := message.Tag()
+	subs := p.subscriptions.match(tag)
+	if len(subs) > 0 {
 		messages := make([]Message, len(subs))
 		writers := make([]io.Writer, len(subs))
 		for i := range messages {
-			messages[i] = NewMessage(tag)
+			messages[i] = newMessageWithID(tag, message.ID())
+			copyMetadata(message, messages[i])
 			writers[i] = messages[i].(io.Writer)
 		}
 		writer := io.MultiWriter(writers...)
 		io.Copy(writer, payload)
 
 		for i := range subs {
-			go subs[i].Receive(messages[i])
+			subs[i].(*subscription).queue.push(messages[i])
 		}
 	}
 }
 
 func (p *publisher) Subscribe(tag string, subCreater func() Subscriber) Subscriber {
+	return p.subscribe(tag, nil, subCreater)
+}
+
+func (p *publisher) SubscribeFrom(tag string, since time.Time, subCreater func() Subscriber) Subscriber {
+	return p.subscribe(tag, &since, subCreater)
+}
+
+//  Subscribes a new Subscriber and queues the history since the given time
+//  (if not nil) and the retained values for it. All of this happens while the
+//  lock is held, so no live message can slip in between.
+func (p *publisher) subscribe(tag string, since *time.Time, subCreater func() Subscriber) Subscriber {
 	p.Lock()
 	defer p.Unlock()
 
-	if _, ok := p.subscribers[tag]; !ok {
-		p.subscribers[tag] = make([]Subscriber, 0)
-	}
 	result := subCreater()
-	p.subscribers[tag] = append(p.subscribers[tag], result)
+	if p.closed {
+		closeSubscriber(result)
+		return result
+	}
+	queue := p.acquireQueue(result)
+	p.subscriptions.insert(tag, &subscription{
+		pattern:    tag,
+		subscriber: result,
+		queue:      queue,
+	})
+	var replayed map[string]bool
+	if since != nil {
+		replayed = p.deliverHistory(tag, *since, queue)
+	}
+	p.deliverRetained(tag, queue, replayed)
 	return result
 }
 
 func (p *publisher) Unsubscribe(tag string, subscriber Subscriber) {
-	subs, ok := p.subscribers[tag]
-	subPosition := -1
-	if ok {
-		for i := range subs {
-			if subs[i] == subscriber {
-				subPosition = i
-				break
-			}
+	p.Lock()
+	defer p.Unlock()
+
+	removed := p.subscriptions.remove(tag, func(value interface{}) bool {
+		return value.(*subscription).subscriber == subscriber
+	})
+	if removed != nil {
+		p.releaseQueue(subscriber)
+	}
+}
+
+func (p *publisher) acquireQueue(subscriber Subscriber) *deliveryQueue {
+	current, ok := p.queues[subscriber]
+	if !ok {
+		current = &subscriberQueue{queue: newDeliveryQueue(subscriber)}
+		p.queues[subscriber] = current
+	}
+	current.subscriptions++
+	return current.queue
+}
+
+//  Closes the queue of the subscriber once its last subscription is gone.
+//  Messages that were published before are still delivered.
+func (p *publisher) releaseQueue(subscriber Subscriber) {
+	current, ok := p.queues[subscriber]
+	if !ok {
+		return
+	}
+	current.subscriptions--
+	if current.subscriptions == 0 {
+		current.queue.close()
+		delete(p.queues, subscriber)
+	}
+}
+
+func (p *publisher) Close() error {
+	queues, err := p.stop()
+	if err != nil {
+		return err
+	}
+	for _, current := range queues {
+		current.queue.close()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, current := range queues {
+			<-current.queue.done
 		}
-		if subPosition != -1 {
-			p.subscribers[tag] = append(subs[:subPosition], subs[subPosition+1:]...)
+	}()
+
+	//  A Subscriber that nobody reads from blocks its queue forever. Once no
+	//  queue made progress for a while, closing the subscribers releases it.
+	ticker := time.NewTicker(CLOSE_STALL_TIMEOUT)
+	defer ticker.Stop()
+	last := deliveredBy(queues)
+	for stalled := false; !stalled; {
+		select {
+		case <-done:
+			stalled = true
+		case <-ticker.C:
+			current := deliveredBy(queues)
+			stalled = current == last
+			last = current
 		}
 	}
+	for subscriber := range queues {
+		closeSubscriber(subscriber)
+	}
+	<-done
+	return nil
+}
+
+func deliveredBy(queues map[Subscriber]*subscriberQueue) uint64 {
+	var result uint64
+	for _, current := range queues {
+		result += current.queue.delivered()
+	}
+	return result
+}
+
+func (p *publisher) Drain(ctx context.Context) error {
+	queues, err := p.stop()
+	if err != nil {
+		return err
+	}
+	for _, current := range queues {
+		current.queue.close()
+	}
+
+	for _, current := range queues {
+		select {
+		case <-current.queue.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	for subscriber := range queues {
+		closeSubscriber(subscriber)
+	}
+	return err
+}
+
+//  Stops accepting new messages and subscriptions and returns the queues of
+//  all subscribers.
+func (p *publisher) stop() (map[Subscriber]*subscriberQueue, error) {
+	p.Lock()
+	defer p.Unlock()
+	if p.closed {
+		return nil, ErrPublisherClosed
+	}
+	p.closed = true
+	p.subscriptions = newTagTrie()
+	queues := p.queues
+	p.queues = make(map[Subscriber]*subscriberQueue)
+	return queues, nil
+}
+
+func closeSubscriber(subscriber Subscriber) {
+	if closer, ok := subscriber.(io.Closer); ok {
+		closer.Close()
+	}
 }
@@ -1,12 +1,17 @@
 package pub
 
 import (
+	"context"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type testSubscriber struct {
 	received bool
+	sync.Mutex
 }
 
 func (t *testSubscriber) WaitForMessage() Message {
@@ -14,6 +19,8 @@ func (t *testSubscriber) WaitForMessage() Message {
 }
 
 func (t *testSubscriber) Receive(message Message) {
+	t.Lock()
+	defer t.Unlock()
 	t.received = true
 }
 
@@ -22,6 +29,8 @@ func newTestSubscriber() Subscriber {
 }
 
 func (t *testSubscriber) hasReceived() bool {
+	t.Lock()
+	defer t.Unlock()
 	return t.received
 }
 
@@ -59,4 +68,318 @@ var _ = Describe("Publisher", func() {
 			Consistently(testSub.hasReceived).Should(BeFalse())
 		})
 	})
+
+	Context("wildcard subscriber", func() {
+		var exactSub, singleSub, multiSub *testSubscriber
+
+		BeforeEach(func() {
+			pub = New()
+			exactSub = pub.Subscribe("orders.eu.created", newTestSubscriber).(*testSubscriber)
+			singleSub = pub.Subscribe("orders.*.created", newTestSubscriber).(*testSubscriber)
+			multiSub = pub.Subscribe("orders.>", newTestSubscriber).(*testSubscriber)
+		})
+
+		It("should publish to all matching subs", func() {
+			input = NewMessage("orders.eu.created")
+			input.Write(inputBytes)
+			pub.Publish(input)
+			Eventually(exactSub.hasReceived).Should(BeTrue())
+			Eventually(singleSub.hasReceived).Should(BeTrue())
+			Eventually(multiSub.hasReceived).Should(BeTrue())
+		})
+
+		It("should only publish to the multi level sub", func() {
+			input = NewMessage("orders.eu.us.created")
+			input.Write(inputBytes)
+			pub.Publish(input)
+			Eventually(multiSub.hasReceived).Should(BeTrue())
+			Consistently(exactSub.hasReceived).Should(BeFalse())
+			Consistently(singleSub.hasReceived).Should(BeFalse())
+		})
+
+		It("should not publish to an unsubscribed sub", func() {
+			pub.Unsubscribe("orders.>", multiSub)
+			input = NewMessage("orders.eu.created")
+			input.Write(inputBytes)
+			pub.Publish(input)
+			Eventually(singleSub.hasReceived).Should(BeTrue())
+			Consistently(multiSub.hasReceived).Should(BeFalse())
+		})
+	})
+
+	Context("ordering", func() {
+		const messageCount = 1000
+
+		It("should deliver the messages of a tag in publish order", func() {
+			pub = New()
+			subs := make([]*recordingSubscriber, 4)
+			for i := range subs {
+				subs[i] = pub.Subscribe("order.test", newRecordingSubscriber).(*recordingSubscriber)
+			}
+
+			expected := make([]string, messageCount)
+			for i := range expected {
+				expected[i] = strconv.Itoa(i)
+				message := NewMessage("order.test")
+				message.Write([]byte(expected[i]))
+				pub.Publish(message)
+			}
+
+			for i := range subs {
+				Eventually(subs[i].received, 5*time.Second).Should(Equal(expected))
+			}
+		})
+
+		It("should deliver concurrently published messages in the same order to every sub", func() {
+			pub = New()
+			first := pub.Subscribe("order.>", newRecordingSubscriber).(*recordingSubscriber)
+			second := pub.Subscribe("order.*", newRecordingSubscriber).(*recordingSubscriber)
+
+			var wg sync.WaitGroup
+			for publisherId := 0; publisherId < 4; publisherId++ {
+				wg.Add(1)
+				go func(publisherId int) {
+					defer wg.Done()
+					tag := "order." + strconv.Itoa(publisherId)
+					for i := 0; i < messageCount/4; i++ {
+						message := NewMessage(tag)
+						message.Write([]byte(tag + ":" + strconv.Itoa(i)))
+						pub.Publish(message)
+					}
+				}(publisherId)
+			}
+			wg.Wait()
+
+			Eventually(func() int { return len(first.received()) }, 5*time.Second).Should(Equal(messageCount))
+			Eventually(second.received, 5*time.Second).Should(Equal(first.received()))
+		})
+
+		It("should keep the global order for a sub with several subscriptions", func() {
+			pub = New()
+			sub := newRecordingSubscriber().(*recordingSubscriber)
+			pub.Subscribe("first", func() Subscriber { return sub })
+			pub.Subscribe("second", func() Subscriber { return sub })
+
+			expected := make([]string, messageCount)
+			for i := range expected {
+				tag := "first"
+				if i%2 == 1 {
+					tag = "second"
+				}
+				expected[i] = tag + ":" + strconv.Itoa(i)
+				message := NewMessage(tag)
+				message.Write([]byte(expected[i]))
+				pub.Publish(message)
+			}
+
+			Eventually(sub.received, 5*time.Second).Should(Equal(expected))
+		})
+	})
+
+	Context("lifecycle", func() {
+		BeforeEach(func() {
+			pub = New()
+		})
+
+		It("should not publish after close", func() {
+			Expect(pub.Close()).Should(Succeed())
+			input = NewMessage("test")
+			Expect(pub.Publish(input)).Should(Equal(ErrPublisherClosed))
+			Expect(pub.Close()).Should(Equal(ErrPublisherClosed))
+		})
+
+		It("should deliver pending messages before closing the subs", func() {
+			sub = pub.Subscribe("test", func() Subscriber {
+				return NewSubscriberWithOptions(SubscriberOptions{BufferSize: 100})
+			})
+			for i := 0; i < 50; i++ {
+				input = NewMessage("test")
+				input.Write(inputBytes)
+				Expect(pub.Publish(input)).Should(Succeed())
+			}
+			Expect(pub.Close()).Should(Succeed())
+
+			for i := 0; i < 50; i++ {
+				Expect(sub.WaitForMessage()).ShouldNot(BeNil())
+			}
+			Expect(sub.WaitForMessage()).Should(BeNil())
+			_, err := sub.(ContextSubscriber).TryWaitForMessage()
+			Expect(err).Should(Equal(ErrSubscriberClosed))
+		})
+
+		It("should close a subscriber that nobody reads", func() {
+			sub = pub.Subscribe("test", NewSubscriber)
+			for i := 0; i < DEFAULT_SUBSCRIBER_BUFFER+6; i++ {
+				input = NewMessage("test")
+				input.Write(inputBytes)
+				pub.Publish(input)
+			}
+			closed := make(chan error, 1)
+			go func() {
+				closed <- pub.Close()
+			}()
+			Eventually(closed, 3*CLOSE_STALL_TIMEOUT).Should(Receive(BeNil()))
+			for i := 0; i < DEFAULT_SUBSCRIBER_BUFFER; i++ {
+				Expect(sub.WaitForMessage()).ShouldNot(BeNil())
+			}
+			Expect(sub.WaitForMessage()).Should(BeNil())
+		})
+
+		It("should stop draining at the deadline", func() {
+			sub = pub.Subscribe("test", NewSubscriber)
+			for i := 0; i < DEFAULT_SUBSCRIBER_BUFFER+2; i++ {
+				input = NewMessage("test")
+				input.Write(inputBytes)
+				pub.Publish(input)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			Expect(pub.Drain(ctx)).Should(Equal(context.DeadlineExceeded))
+			_, err := sub.(ContextSubscriber).TryWaitForMessage()
+			Expect(err).Should(Succeed())
+		})
+
+		It("should close subs created after close", func() {
+			pub.Close()
+			sub = pub.Subscribe("test", NewSubscriber)
+			Expect(sub.WaitForMessage()).Should(BeNil())
+		})
+	})
+
+	Context("retained messages", func() {
+		BeforeEach(func() {
+			pub = New()
+		})
+
+		publishRetained := func(tag, payload string) {
+			message := NewMessage(tag)
+			message.Write([]byte(payload))
+			Expect(pub.PublishRetained(message)).Should(Succeed())
+		}
+
+		It("should deliver the retained value to later subs", func() {
+			early := pub.Subscribe("config.db", newRecordingSubscriber).(*recordingSubscriber)
+			publishRetained("config.db", "first")
+			publishRetained("config.db", "second")
+			Eventually(early.received).Should(Equal([]string{"first", "second"}))
+
+			late := pub.Subscribe("config.db", newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(late.received).Should(Equal([]string{"second"}))
+			Consistently(late.received).Should(HaveLen(1))
+		})
+
+		It("should deliver all matching retained values before live messages", func() {
+			publishRetained("config.db", "db")
+			publishRetained("config.cache", "cache")
+			publishRetained("status", "up")
+
+			late := pub.Subscribe("config.*", newRecordingSubscriber).(*recordingSubscriber)
+			input = NewMessage("config.db")
+			input.Write([]byte("live"))
+			pub.Publish(input)
+			Eventually(late.received).Should(Equal([]string{"cache", "db", "live"}))
+		})
+
+		It("should not retain normal messages", func() {
+			input = NewMessage("config.db")
+			input.Write(inputBytes)
+			pub.Publish(input)
+			late := pub.Subscribe("config.db", newRecordingSubscriber).(*recordingSubscriber)
+			Consistently(late.received).Should(BeEmpty())
+		})
+
+		It("should clear the retained value", func() {
+			publishRetained("config.db", "db")
+			pub.ClearRetained("config.db")
+			late := pub.Subscribe("config.db", newRecordingSubscriber).(*recordingSubscriber)
+			Consistently(late.received).Should(BeEmpty())
+		})
+	})
+
+	Context("history", func() {
+		publishAll := func(tag string, from, to int) {
+			for i := from; i < to; i++ {
+				input = NewMessage(tag)
+				input.Write([]byte(strconv.Itoa(i)))
+				pub.Publish(input)
+			}
+		}
+
+		numbers := func(from, to int) []string {
+			result := make([]string, 0)
+			for i := from; i < to; i++ {
+				result = append(result, strconv.Itoa(i))
+			}
+			return result
+		}
+
+		It("should replay the last messages", func() {
+			pub = NewWithOptions(PublisherOptions{HistorySize: 5})
+			publishAll("history", 0, 10)
+			sub := pub.SubscribeFrom("history", time.Time{}, newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(sub.received).Should(Equal(numbers(5, 10)))
+		})
+
+		It("should only replay messages since the given time", func() {
+			pub = NewWithOptions(PublisherOptions{HistorySize: 100})
+			publishAll("history", 0, 3)
+			time.Sleep(5 * time.Millisecond)
+			since := time.Now()
+			publishAll("history", 3, 6)
+			sub := pub.SubscribeFrom("history", since, newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(sub.received).Should(Equal(numbers(3, 6)))
+		})
+
+		It("should replay matching tags in publish order", func() {
+			pub = NewWithOptions(PublisherOptions{HistoryAge: time.Minute})
+			for i := 0; i < 6; i++ {
+				input = NewMessage("history." + strconv.Itoa(i%3))
+				input.Write([]byte(strconv.Itoa(i)))
+				pub.Publish(input)
+			}
+			sub := pub.SubscribeFrom("history.*", time.Time{}, newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(sub.received).Should(Equal(numbers(0, 6)))
+		})
+
+		It("should switch to live delivery without gaps or duplicates", func() {
+			pub = NewWithOptions(PublisherOptions{HistorySize: 1000})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				publishAll("history", 0, 500)
+			}()
+			time.Sleep(time.Millisecond)
+			sub := pub.SubscribeFrom("history", time.Time{}, newRecordingSubscriber).(*recordingSubscriber)
+			<-done
+			Eventually(sub.received, 5*time.Second).Should(Equal(numbers(0, 500)))
+		})
+
+		It("should forget the history of expired tags", func() {
+			pub = NewWithOptions(PublisherOptions{HistoryAge: 20 * time.Millisecond})
+			for i := 0; i < 100; i++ {
+				publishAll("history."+strconv.Itoa(i), 0, 1)
+			}
+			Expect(pub.(*publisher).history).Should(HaveLen(100))
+			time.Sleep(30 * time.Millisecond)
+			publishAll("history.new", 0, 1)
+			Expect(pub.(*publisher).history).Should(HaveLen(1))
+		})
+
+		It("should not replay a retained value twice", func() {
+			pub = NewWithOptions(PublisherOptions{HistorySize: 10})
+			input = NewMessage("config")
+			input.Write([]byte("0"))
+			pub.PublishRetained(input)
+			input = NewMessage("state")
+			input.Write([]byte("1"))
+			pub.PublishRetained(input)
+
+			since := time.Now().Add(time.Hour)
+			sub := pub.SubscribeFrom(">", time.Time{}, newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(sub.received).Should(Equal(numbers(0, 2)))
+			late := pub.SubscribeFrom(">", since, newRecordingSubscriber).(*recordingSubscriber)
+			Eventually(late.received).Should(Equal(numbers(0, 2)))
+			Consistently(sub.received).Should(HaveLen(2))
+		})
+	})
 })
@@ -0,0 +1,76 @@
+package pub
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+//	A deliveryQueue hands messages to a single Subscriber in the order they were
+//	pushed. The queue is unbounded, so pushing never blocks the publisher. A
+//	dedicated goroutine calls Receive for one message at a time, the next message
+//	is only delivered after Receive returned.
+type deliveryQueue struct {
+	count      uint64
+	subscriber Subscriber
+	messages   []Message
+	closed     bool
+	cond       *sync.Cond
+	done       chan struct{}
+}
+
+func newDeliveryQueue(subscriber Subscriber) *deliveryQueue {
+	q := &deliveryQueue{
+		subscriber: subscriber,
+		messages:   make([]Message, 0),
+		cond:       sync.NewCond(&sync.Mutex{}),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+//	Appends the message to the queue. Messages pushed after close are discarded.
+func (q *deliveryQueue) push(message Message) {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	if q.closed {
+		return
+	}
+	q.messages = append(q.messages, message)
+	q.cond.Signal()
+}
+
+//	Stops the queue. Messages that are already queued are still delivered, done
+//	is closed once the last of them was received.
+func (q *deliveryQueue) close() {
+	q.cond.L.Lock()
+	defer q.cond.L.Unlock()
+	q.closed = true
+	q.cond.Signal()
+}
+
+func (q *deliveryQueue) run() {
+	defer close(q.done)
+	for {
+		q.cond.L.Lock()
+		for len(q.messages) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.messages) == 0 {
+			q.cond.L.Unlock()
+			return
+		}
+		message := q.messages[0]
+		q.messages[0] = nil
+		q.messages = q.messages[1:]
+		q.cond.L.Unlock()
+
+		q.subscriber.Receive(message)
+		atomic.AddUint64(&q.count, 1)
+	}
+}
+
+//	Returns how many messages were delivered so far.
+func (q *deliveryQueue) delivered() uint64 {
+	return atomic.LoadUint64(&q.count)
+}
@@ -0,0 +1,634 @@
+package pub
+
+import (
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_MIN_BACKOFF      = 100 * time.Millisecond
+	DEFAULT_MAX_BACKOFF      = 30 * time.Second
+	DEFAULT_RECONNECT_BUFFER = 256
+)
+
+var (
+	ErrOffline    = errors.New("connection is offline")
+	ErrBufferFull = errors.New("offline buffer is full")
+	ErrClosed     = errors.New("connection is closed")
+)
+
+//	The states of a ReconnectingConnection.
+type ConnectionState int
+
+const (
+	STATE_CONNECTING ConnectionState = iota
+	STATE_CONNECTED
+	STATE_DISCONNECTED
+	STATE_CLOSED
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case STATE_CONNECTING:
+		return "connecting"
+	case STATE_CONNECTED:
+		return "connected"
+	case STATE_DISCONNECTED:
+		return "disconnected"
+	case STATE_CLOSED:
+		return "closed"
+	}
+	return "unknown"
+}
+
+//	ReconnectOptions configure a ReconnectingConnection.
+type ReconnectOptions struct {
+	//	The delay before the first redial. It doubles with every failed attempt
+	//	up to MaxBackoff. Every delay is randomized between half and all of it,
+	//	so that many clients don't redial at the same time. Zero means
+	//	DEFAULT_MIN_BACKOFF and DEFAULT_MAX_BACKOFF.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	//	How many messages are buffered while offline. Zero means
+	//	DEFAULT_RECONNECT_BUFFER, negative disables the buffer.
+	BufferSize int
+
+	//	Called on every change of the state. err is the reason of a
+	//	STATE_DISCONNECTED, nil otherwise. The calls are made one after another
+	//	from a single goroutine and must not block for long.
+	OnStateChange func(state ConnectionState, err error)
+}
+
+//	A ReconnectingConnection is a Connection to a Messenger that redials
+//	whenever the current connection fails, with exponential backoff and jitter.
+//	Every new connection registers with the same connection ID, so the remote
+//	can claim it with StartConversation or AwaitConversation again.
+//
+//	Messages that are sent while offline are buffered and sent in order once
+//	connected again. Subscriptions of a RemotePublisher that uses the
+//	ReconnectingConnection are re-established on every new connection. They ask
+//	for the messages since the connection was lost, so a Publisher with a
+//	history fills the gap, and messages around the loss may be delivered twice.
+//	Subscribe of a RemotePublisher waits while offline until the subscription
+//	was confirmed after reconnecting, and so does Publish until the remote
+//	answered. Publishes that were sent, but not answered before the connection
+//	was lost, are sent again, so they may reach the remote twice.
+//
+//	Receiving blocks across reconnects, every failed read or write drops the
+//	current connection and redials. Strings, files and streams are only
+//	passed to the current connection and fail with ErrOffline without one.
+type ReconnectingConnection struct {
+	messenger     Messenger
+	network       string
+	address       string
+	connId        string
+	options       ReconnectOptions
+	current       Connection
+	state         ConnectionState
+	buffer        []storedMessage
+	unanswered    []storedMessage
+	subscriptions map[string]*trackedSubscription
+	order         []string
+	lostAt        time.Time
+	readDeadline  time.Time
+	writeDeadline time.Time
+	changed       chan struct{}
+	lost          chan error
+	stop          chan struct{}
+	done          chan struct{}
+	sendLock      sync.Mutex
+	sync.Mutex
+}
+
+//	A subscription of a RemotePublisher. Once it was established, it is
+//	replayed with the time the connection was lost.
+type trackedSubscription struct {
+	request     storedMessage
+	established bool
+}
+
+//	Returns a ReconnectingConnection that dials the address with the messenger
+//	and registers as connId. It connects in the background, use OnStateChange
+//	or State to learn when it is connected.
+func NewReconnectingConnection(messenger Messenger, network, address, connId string, options ReconnectOptions) *ReconnectingConnection {
+	if options.MinBackoff <= 0 {
+		options.MinBackoff = DEFAULT_MIN_BACKOFF
+	}
+	if options.MaxBackoff <= 0 {
+		options.MaxBackoff = DEFAULT_MAX_BACKOFF
+	}
+	if options.MaxBackoff < options.MinBackoff {
+		options.MaxBackoff = options.MinBackoff
+	}
+	if options.BufferSize == 0 {
+		options.BufferSize = DEFAULT_RECONNECT_BUFFER
+	}
+	result := &ReconnectingConnection{
+		messenger:     messenger,
+		network:       network,
+		address:       address,
+		connId:        connId,
+		options:       options,
+		subscriptions: make(map[string]*trackedSubscription),
+		changed:       make(chan struct{}),
+		lost:          make(chan error, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	go result.run()
+	return result
+}
+
+func (r *ReconnectingConnection) run() {
+	defer close(r.done)
+	defer func() {
+		if r.options.OnStateChange != nil {
+			r.options.OnStateChange(STATE_CLOSED, nil)
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		r.setState(STATE_CONNECTING, nil)
+		err := r.connect()
+		if err == nil {
+			attempt = 0
+			r.setState(STATE_CONNECTED, nil)
+			select {
+			case err = <-r.lost:
+			case <-r.stop:
+				return
+			}
+		}
+		r.setState(STATE_DISCONNECTED, err)
+		timer := time.NewTimer(r.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-r.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+//	Returns the delay after the given number of failed attempts.
+func (r *ReconnectingConnection) backoff(attempt int) time.Duration {
+	delay := r.options.MinBackoff
+	for i := 0; i < attempt && delay < r.options.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.options.MaxBackoff {
+		delay = r.options.MaxBackoff
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+//	Dials, registers and replays the subscriptions and the buffer before the
+//	new connection is used.
+func (r *ReconnectingConnection) connect() error {
+	conn, err := r.messenger.TalkOn(r.network, r.address)
+	if err != nil {
+		return err
+	}
+	err = conn.SendString(r.connId)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	r.Lock()
+	lostAt := r.lostAt
+	replay := make([]Message, 0, len(r.order)+len(r.unanswered)+len(r.buffer))
+	for _, id := range r.order {
+		subscription := r.subscriptions[id]
+		request := subscription.request.message()
+		if subscription.established && !lostAt.IsZero() {
+			request.SetHeader(SINCE_HEADER, lostAt.Format(time.RFC3339Nano))
+		}
+		replay = append(replay, request)
+	}
+	for _, stored := range r.unanswered {
+		replay = append(replay, stored.message())
+	}
+	for _, stored := range r.buffer {
+		replay = append(replay, stored.message())
+	}
+	r.Unlock()
+
+	for _, message := range replay {
+		err = conn.SendMessage(message)
+		if err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if r.state == STATE_CLOSED {
+		conn.Close()
+		return ErrClosed
+	}
+	for _, stored := range r.buffer {
+		if stored.header.Header(REQUEST_HEADER) != "" {
+			r.unanswered = append(r.unanswered, stored)
+		}
+	}
+	r.buffer = nil
+	for _, subscription := range r.subscriptions {
+		subscription.established = true
+	}
+	conn.SetReadDeadline(r.readDeadline)
+	conn.SetWriteDeadline(r.writeDeadline)
+	r.current = conn
+	return nil
+}
+
+func (r *ReconnectingConnection) setState(state ConnectionState, err error) {
+	r.Lock()
+	if r.state == STATE_CLOSED {
+		r.Unlock()
+		return
+	}
+	r.state = state
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.Unlock()
+	if r.options.OnStateChange != nil {
+		r.options.OnStateChange(state, err)
+	}
+}
+
+//	Drops conn if it is still the current connection and makes run redial.
+func (r *ReconnectingConnection) drop(conn Connection, err error) {
+	r.Lock()
+	defer r.Unlock()
+	if r.current != conn {
+		return
+	}
+	r.current = nil
+	r.lostAt = time.Now()
+	conn.Close()
+	select {
+	case r.lost <- err:
+	default:
+	}
+}
+
+//	Returns the current state.
+func (r *ReconnectingConnection) State() ConnectionState {
+	r.Lock()
+	defer r.Unlock()
+	return r.state
+}
+
+//	Returns the current connection, waiting for one until the read deadline if
+//	wait is set.
+func (r *ReconnectingConnection) connection(wait bool) (Connection, error) {
+	for {
+		r.Lock()
+		conn, state, changed, deadline := r.current, r.state, r.changed, r.readDeadline
+		r.Unlock()
+		if state == STATE_CLOSED {
+			return nil, ErrClosed
+		}
+		if conn != nil {
+			return conn, nil
+		}
+		if !wait {
+			return nil, ErrOffline
+		}
+		if deadline.IsZero() {
+			<-changed
+			continue
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+//	Timeouts are returned instead of redialing, but the connection is dropped
+//	all the same, as it may be in the middle of an item.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+//	Sends the message or buffers it while offline. Returns ErrBufferFull if the
+//	buffer has no room left. A message whose sending fails is buffered as well,
+//	so it may reach the remote twice.
+func (r *ReconnectingConnection) SendMessage(message Message) error {
+	message.Close()
+	payload, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	stored := newStoredMessage(message, payload)
+
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	r.Lock()
+	if r.state == STATE_CLOSED {
+		r.Unlock()
+		return ErrClosed
+	}
+	isSubscription := r.track(stored)
+	conn := r.current
+	request := stored.header.Header(REQUEST_HEADER)
+	if conn != nil && request != "" {
+		//	Tracked before sending, as the answer may arrive before SendMessage
+		//	returns.
+		r.unanswered = append(r.unanswered, stored)
+	}
+	r.Unlock()
+
+	if conn != nil {
+		err = conn.SendMessage(stored.message())
+		if err == nil {
+			return nil
+		}
+		r.drop(conn, err)
+	}
+	if isSubscription {
+		//	Subscriptions are replayed on the next connection anyway.
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.answered(request)
+	if len(r.buffer) >= r.options.BufferSize {
+		return ErrBufferFull
+	}
+	r.buffer = append(r.buffer, stored)
+	return nil
+}
+
+//	Remembers the subscriptions of a RemotePublisher. Returns true for
+//	subscribe and unsubscribe requests.
+func (r *ReconnectingConnection) track(stored storedMessage) bool {
+	id := stored.header.Header(SUBSCRIPTION_HEADER)
+	switch stored.header.Header(OP_HEADER) {
+	case OP_SUBSCRIBE:
+		if _, ok := r.subscriptions[id]; !ok {
+			r.order = append(r.order, id)
+		}
+		r.subscriptions[id] = &trackedSubscription{request: stored, established: r.current != nil}
+		return true
+	case OP_UNSUBSCRIBE:
+		r.forget(id)
+		return true
+	}
+	return false
+}
+
+func (r *ReconnectingConnection) forget(subscription string) {
+	delete(r.subscriptions, subscription)
+	for i, current := range r.order {
+		if current == subscription {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+//	Stops tracking the publish with the given request ID.
+func (r *ReconnectingConnection) answered(request string) {
+	if request == "" {
+		return
+	}
+	for i, stored := range r.unanswered {
+		if stored.header.Header(REQUEST_HEADER) == request {
+			r.unanswered = append(r.unanswered[:i], r.unanswered[i+1:]...)
+			return
+		}
+	}
+}
+
+//	Notices the answers of the remote to tracked requests: answered publishes
+//	are not sent again, denied subscriptions are not replayed.
+func (r *ReconnectingConnection) observe(message Message) {
+	r.Lock()
+	defer r.Unlock()
+	if request := message.Header(REQUEST_HEADER); request != "" {
+		r.answered(request)
+	} else if message.Header(OP_HEADER) == OP_DENIED {
+		r.forget(message.Header(SUBSCRIPTION_HEADER))
+	}
+}
+
+func (r *ReconnectingConnection) SendString(message string) error {
+	conn, err := r.connection(false)
+	if err != nil {
+		return err
+	}
+	err = conn.SendString(message)
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return err
+}
+
+func (r *ReconnectingConnection) SendAndCloseFile(file *os.File) error {
+	conn, err := r.connection(false)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = conn.SendAndCloseFile(file)
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return err
+}
+
+func (r *ReconnectingConnection) ReceiveMessageWithTag(tag string) (Message, error) {
+	message, err := r.ReceiveMessage()
+	if err != nil {
+		return nil, err
+	}
+	if message.Tag() != tag {
+		return nil, errors.New("the received tag didn't match the expected tag")
+	}
+	return message, nil
+}
+
+//	Waits for a message, redialing as often as necessary. Returns ErrClosed
+//	once the ReconnectingConnection is closed and a timeout error once the read
+//	deadline passed.
+func (r *ReconnectingConnection) ReceiveMessage() (Message, error) {
+	for {
+		conn, err := r.connection(true)
+		if err != nil {
+			return nil, err
+		}
+		message, err := conn.ReceiveMessage()
+		if err == nil {
+			r.observe(message)
+			return message, nil
+		}
+		r.drop(conn, err)
+		if isTimeout(err) {
+			return nil, err
+		}
+	}
+}
+
+//	Waits for a string, redialing as often as necessary. Returns ErrClosed
+//	once the ReconnectingConnection is closed and a timeout error once the read
+//	deadline passed.
+func (r *ReconnectingConnection) ReceiveString() (string, error) {
+	for {
+		conn, err := r.connection(true)
+		if err != nil {
+			return "", err
+		}
+		message, err := conn.ReceiveString()
+		if err == nil {
+			return message, nil
+		}
+		r.drop(conn, err)
+		if isTimeout(err) {
+			return "", err
+		}
+	}
+}
+
+func (r *ReconnectingConnection) ReceiveFile(filename string) (*os.File, error) {
+	conn, err := r.connection(false)
+	if err != nil {
+		return nil, err
+	}
+	file, err := conn.ReceiveFile(filename)
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return file, err
+}
+
+func (r *ReconnectingConnection) StartStream() error {
+	conn, err := r.connection(false)
+	if err != nil {
+		return err
+	}
+	err = conn.StartStream()
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return err
+}
+
+func (r *ReconnectingConnection) StopStream() error {
+	conn, err := r.connection(false)
+	if err != nil {
+		return err
+	}
+	err = conn.StopStream()
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return err
+}
+
+//	Returns the Peer of the current connection, the zero Peer while offline.
+func (r *ReconnectingConnection) Peer() Peer {
+	conn, err := r.connection(false)
+	if err != nil {
+		return Peer{}
+	}
+	return conn.Peer()
+}
+
+func (r *ReconnectingConnection) Read(p []byte) (int, error) {
+	conn, err := r.connection(false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(p)
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return n, err
+}
+
+func (r *ReconnectingConnection) Write(p []byte) (int, error) {
+	conn, err := r.connection(false)
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Write(p)
+	if err != nil {
+		r.drop(conn, err)
+	}
+	return n, err
+}
+
+//	Sets the deadlines of the current connection and of every following one.
+//	Receiving waits for a connection only until the read deadline.
+func (r *ReconnectingConnection) SetDeadline(t time.Time) error {
+	err := r.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return r.SetWriteDeadline(t)
+}
+
+func (r *ReconnectingConnection) SetReadDeadline(t time.Time) error {
+	r.Lock()
+	r.readDeadline = t
+	conn := r.current
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.Unlock()
+	if conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (r *ReconnectingConnection) SetWriteDeadline(t time.Time) error {
+	r.Lock()
+	r.writeDeadline = t
+	conn := r.current
+	r.Unlock()
+	if conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+//	Stops redialing and closes the current connection. Messages that are still
+//	buffered are discarded. STATE_CLOSED is reported once redialing stopped.
+func (r *ReconnectingConnection) Close() error {
+	r.Lock()
+	if r.state == STATE_CLOSED {
+		r.Unlock()
+		return nil
+	}
+	conn := r.current
+	r.current = nil
+	r.buffer = nil
+	r.state = STATE_CLOSED
+	close(r.changed)
+	r.changed = make(chan struct{})
+	r.Unlock()
+	close(r.stop)
+
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
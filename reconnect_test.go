@@ -0,0 +1,143 @@
+package pub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"time"
+)
+
+var _ = Describe("ReconnectingConnection", func() {
+	var server Messenger
+	var broker Publisher
+	var address string
+	var served chan Connection
+	var stopServing context.CancelFunc
+	var states chan ConnectionState
+	var options ReconnectOptions
+
+	//	Serves the broker to every connection that registers as "client".
+	serve := func(ctx context.Context, server Messenger, broker Publisher, served chan<- Connection) {
+		for {
+			conn, err := server.AwaitConversation(ctx, "client")
+			if err != nil {
+				return
+			}
+			served <- conn
+			go func() {
+				ServePublisher(conn, broker)
+				conn.Close()
+			}()
+		}
+	}
+
+	BeforeEach(func() {
+		broker = New()
+		server = NewMessenger()
+		bound, err := server.ListenOn("tcp", "127.0.0.1:0", New())
+		Expect(err).Should(Succeed())
+		address = bound.String()
+		served = make(chan Connection, 10)
+		var ctx context.Context
+		ctx, stopServing = context.WithCancel(context.Background())
+		go serve(ctx, server, broker, served)
+
+		reported := make(chan ConnectionState, 100)
+		states = reported
+		options = ReconnectOptions{
+			MinBackoff: 5 * time.Millisecond,
+			MaxBackoff: 20 * time.Millisecond,
+			OnStateChange: func(state ConnectionState, err error) {
+				reported <- state
+			},
+		}
+	})
+
+	AfterEach(func() {
+		stopServing()
+		server.StopListening()
+		broker.Close()
+	})
+
+	expectState := func(expected ConnectionState) {
+		Eventually(states).Should(Receive(Equal(expected)))
+	}
+
+	//	Publishes to the broker until the subscriber receives a message, as
+	//	subscribing is asynchronous.
+	expectDelivery := func(sub ChanSubscriber) {
+		Eventually(func() bool {
+			broker.Publish(NewMessage("news"))
+			select {
+			case <-sub.Messages():
+				return true
+			case <-time.After(10 * time.Millisecond):
+				return false
+			}
+		}).Should(BeTrue())
+	}
+
+	It("should redial and re-establish subscriptions", func() {
+		conn := NewReconnectingConnection(NewMessenger(), "tcp", address, "client", options)
+		remote := NewRemotePublisher(conn)
+		defer remote.Close()
+		sub := remote.Subscribe("news", NewChanSubscriber).(ChanSubscriber)
+		expectState(STATE_CONNECTING)
+		expectState(STATE_CONNECTED)
+		expectDelivery(sub)
+
+		(<-served).Close()
+		expectState(STATE_DISCONNECTED)
+		expectState(STATE_CONNECTING)
+		expectState(STATE_CONNECTED)
+		Expect(conn.State()).Should(Equal(STATE_CONNECTED))
+		expectDelivery(sub)
+		Expect(remote.Err()).Should(BeNil())
+	})
+
+	It("should buffer messages while offline", func() {
+		conn := NewReconnectingConnection(NewMessenger(), "tcp", address, "client", options)
+		remote := NewRemotePublisher(conn)
+		defer remote.Close()
+		expectState(STATE_CONNECTING)
+		expectState(STATE_CONNECTED)
+
+		received := broker.Subscribe("offline", NewChanSubscriber).(ChanSubscriber)
+		Expect(server.StopListening()).Should(Succeed())
+		(<-served).Close()
+		expectState(STATE_DISCONNECTED)
+		published := make(chan error, 1)
+		go func() {
+			published <- remote.Publish(NewMessage("offline"))
+		}()
+		Consistently(received.Messages(), 50*time.Millisecond).ShouldNot(Receive())
+		Expect(published).ShouldNot(Receive())
+
+		_, err := server.ListenOn("tcp", address, New())
+		Expect(err).Should(Succeed())
+		Eventually(received.Messages()).Should(Receive())
+		Eventually(published).Should(Receive(BeNil()))
+	})
+
+	It("should reject messages once the buffer is full", func() {
+		stopServing()
+		Expect(server.StopListening()).Should(Succeed())
+		options.BufferSize = 1
+		conn := NewReconnectingConnection(NewMessenger(), "tcp", address, "client", options)
+		expectState(STATE_CONNECTING)
+		expectState(STATE_DISCONNECTED)
+
+		Expect(conn.SendMessage(NewMessage("first"))).Should(Succeed())
+		Expect(conn.SendMessage(NewMessage("second"))).Should(Equal(ErrBufferFull))
+		Expect(conn.SendString("string")).Should(Equal(ErrOffline))
+
+		Expect(conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))).Should(Succeed())
+		_, err := conn.ReceiveMessage()
+		Expect(err).Should(HaveOccurred())
+
+		Expect(conn.Close()).Should(Succeed())
+		Eventually(states).Should(Receive(Equal(STATE_CLOSED)))
+		_, err = conn.ReceiveMessage()
+		Expect(err).Should(Equal(ErrClosed))
+	})
+})
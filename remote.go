@@ -0,0 +1,661 @@
+package pub
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//	Headers that are used by RemotePublisher and ServePublisher to tell the
+//	remote what to do with a message. They are removed before a message is
+//	handed to a Publisher or Subscriber.
+const (
+	OP_HEADER           = "pub-op"
+	SUBSCRIPTION_HEADER = "pub-subscription"
+	SINCE_HEADER        = "pub-since"
+	REQUEST_HEADER      = "pub-request"
+	ERROR_HEADER        = "pub-error"
+)
+
+//	Operations of the OP_HEADER.
+const (
+	OP_PUBLISH          = "publish"
+	OP_PUBLISH_RETAINED = "publish-retained"
+	OP_CLEAR_RETAINED   = "clear-retained"
+	OP_SUBSCRIBE        = "subscribe"
+	OP_UNSUBSCRIBE      = "unsubscribe"
+	OP_DELIVER          = "deliver"
+	OP_SUBSCRIBED       = "subscribed"
+	OP_PUBLISHED        = "published"
+	OP_DENIED           = "denied"
+)
+
+var ErrSlowRemote = errors.New("remote fell too far behind its deliveries")
+
+//	A RemotePublisher implements Publisher by proxying every call over a
+//	Connection to a Publisher that is served on the other side by ServePublisher.
+//	Subscribers are local: every Subscribe creates a subscription on the remote
+//	side, whose messages are sent back and delivered to the local Subscriber in
+//	order. Subscribe waits until the remote confirmed the subscription or the
+//	Connection ended, so every message published at the remote afterwards
+//	reaches the Subscriber. If the remote Publisher refused the subscription,
+//	e.g. because an ACL denied it, the Subscriber is returned closed.
+//
+//	Publish and PublishRetained wait until the remote Publisher took the
+//	message and return its error, e.g. ErrPermissionDenied.
+type RemotePublisher struct {
+	conn          Connection
+	subscriptions map[uint64]*remoteSubscription
+	requests      map[string]chan error
+	nextId        uint64
+	nextRequest   uint64
+	closed        bool
+	err           error
+	done          chan struct{}
+	sendLock      sync.Mutex
+	sync.Mutex
+}
+
+type remoteSubscription struct {
+	pattern    string
+	subscriber Subscriber
+	queue      *deliveryQueue
+	confirmed  chan struct{}
+	denied     bool
+}
+
+//	Closes confirmed once. Repeated confirmations follow reconnects.
+func (r *remoteSubscription) confirm() {
+	select {
+	case <-r.confirmed:
+	default:
+		close(r.confirmed)
+	}
+}
+
+//	Returns a RemotePublisher that talks to the Publisher served on the other
+//	side of the Connection. The RemotePublisher owns the Connection from now on:
+//	it reads all incoming messages and closes it on Close.
+func NewRemotePublisher(conn Connection) *RemotePublisher {
+	result := &RemotePublisher{
+		conn:          conn,
+		subscriptions: make(map[uint64]*remoteSubscription),
+		requests:      make(map[string]chan error),
+		done:          make(chan struct{}),
+	}
+	go result.receive()
+	return result
+}
+
+func (r *RemotePublisher) Publish(message Message) error {
+	return r.publish(message, OP_PUBLISH)
+}
+
+func (r *RemotePublisher) PublishRetained(message Message) error {
+	return r.publish(message, OP_PUBLISH_RETAINED)
+}
+
+func (r *RemotePublisher) publish(message Message, op string) error {
+	message.Close()
+	payload, err := ioutil.ReadAll(message)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	r.nextRequest++
+	id := strconv.FormatUint(r.nextRequest, 10)
+	result := make(chan error, 1)
+	r.requests[id] = result
+	r.Unlock()
+	defer func() {
+		r.Lock()
+		delete(r.requests, id)
+		r.Unlock()
+	}()
+
+	request := copyMessage(message, payload)
+	request.SetHeader(OP_HEADER, op)
+	request.SetHeader(REQUEST_HEADER, id)
+	err = r.send(request)
+	if err != nil {
+		return err
+	}
+	select {
+	case err = <-result:
+		return err
+	case <-r.done:
+		if err = r.Err(); err != nil {
+			return err
+		}
+		return ErrPublisherClosed
+	}
+}
+
+func (r *RemotePublisher) ClearRetained(tag string) {
+	request := NewMessage(tag)
+	request.SetHeader(OP_HEADER, OP_CLEAR_RETAINED)
+	r.send(request)
+}
+
+func (r *RemotePublisher) Subscribe(tag string, subCreater func() Subscriber) Subscriber {
+	return r.subscribe(tag, nil, subCreater)
+}
+
+func (r *RemotePublisher) SubscribeFrom(tag string, since time.Time, subCreater func() Subscriber) Subscriber {
+	return r.subscribe(tag, &since, subCreater)
+}
+
+func (r *RemotePublisher) subscribe(tag string, since *time.Time, subCreater func() Subscriber) Subscriber {
+	r.Lock()
+	result := subCreater()
+	if r.closed {
+		r.Unlock()
+		closeSubscriber(result)
+		return result
+	}
+	r.nextId++
+	id := r.nextId
+	subscription := &remoteSubscription{
+		pattern:    tag,
+		subscriber: result,
+		queue:      newDeliveryQueue(result),
+		confirmed:  make(chan struct{}),
+	}
+	r.subscriptions[id] = subscription
+	r.Unlock()
+
+	request := NewMessage(tag)
+	request.SetHeader(OP_HEADER, OP_SUBSCRIBE)
+	request.SetHeader(SUBSCRIPTION_HEADER, strconv.FormatUint(id, 10))
+	if since != nil {
+		request.SetHeader(SINCE_HEADER, since.Format(time.RFC3339Nano))
+	}
+	if r.send(request) != nil {
+		return result
+	}
+	//	Like in-process, messages that are published after Subscribe returned
+	//	must reach the new Subscriber.
+	select {
+	case <-subscription.confirmed:
+	case <-r.done:
+	}
+	r.Lock()
+	denied := subscription.denied
+	r.Unlock()
+	if denied {
+		<-subscription.queue.done
+		closeSubscriber(result)
+	}
+	return result
+}
+
+func (r *RemotePublisher) Unsubscribe(tag string, subscriber Subscriber) {
+	r.Lock()
+	var id uint64
+	var found *remoteSubscription
+	for currentId, current := range r.subscriptions {
+		if current.pattern == tag && current.subscriber == subscriber {
+			id, found = currentId, current
+			break
+		}
+	}
+	if found == nil {
+		r.Unlock()
+		return
+	}
+	delete(r.subscriptions, id)
+	found.queue.close()
+	r.Unlock()
+
+	request := NewMessage(tag)
+	request.SetHeader(OP_HEADER, OP_UNSUBSCRIBE)
+	request.SetHeader(SUBSCRIPTION_HEADER, strconv.FormatUint(id, 10))
+	r.send(request)
+}
+
+func (r *RemotePublisher) send(request Message) error {
+	r.Lock()
+	closed := r.closed
+	r.Unlock()
+	if closed {
+		return ErrPublisherClosed
+	}
+	r.sendLock.Lock()
+	defer r.sendLock.Unlock()
+	return r.conn.SendMessage(request)
+}
+
+//	Returns the error that ended the connection to the remote, if any.
+func (r *RemotePublisher) Err() error {
+	r.Lock()
+	defer r.Unlock()
+	return r.err
+}
+
+//	Returns a channel that is closed once the connection to the remote ended.
+func (r *RemotePublisher) Done() <-chan struct{} {
+	return r.done
+}
+
+//	Closes the Connection and all local Subscribers. Messages that were already
+//	received from the remote are still delivered.
+func (r *RemotePublisher) Close() error {
+	return r.Drain(context.Background())
+}
+
+//	Closes the Connection, waits until the messages that were already received
+//	from the remote are delivered and closes all local Subscribers.
+func (r *RemotePublisher) Drain(ctx context.Context) error {
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		return ErrPublisherClosed
+	}
+	r.closed = true
+	r.Unlock()
+	r.conn.Close()
+	<-r.done
+
+	r.Lock()
+	subscriptions := r.subscriptions
+	r.subscriptions = make(map[uint64]*remoteSubscription)
+	r.Unlock()
+	for _, current := range subscriptions {
+		current.queue.close()
+	}
+	var err error
+	for _, current := range subscriptions {
+		select {
+		case <-current.queue.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if err != nil {
+			break
+		}
+	}
+	for _, current := range subscriptions {
+		closeSubscriber(current.subscriber)
+	}
+	return err
+}
+
+//	Reads the deliveries of the remote until the Connection fails.
+func (r *RemotePublisher) receive() {
+	defer close(r.done)
+	for {
+		message, err := r.conn.ReceiveMessage()
+		if err != nil {
+			r.Lock()
+			if !r.closed {
+				r.err = err
+			}
+			r.Unlock()
+			return
+		}
+		if request := message.Header(REQUEST_HEADER); request != "" {
+			r.answer(request, message)
+			continue
+		}
+		op := message.Header(OP_HEADER)
+		if op != OP_DELIVER && op != OP_SUBSCRIBED && op != OP_DENIED {
+			continue
+		}
+		id, err := strconv.ParseUint(message.Header(SUBSCRIPTION_HEADER), 10, 64)
+		if err != nil {
+			continue
+		}
+		r.Lock()
+		current, ok := r.subscriptions[id]
+		if ok && op == OP_DELIVER {
+			current.queue.push(stripControlHeaders(message))
+		}
+		if ok && op == OP_SUBSCRIBED {
+			current.confirm()
+		}
+		if ok && op == OP_DENIED {
+			r.deny(id, current)
+		}
+		r.Unlock()
+	}
+}
+
+//	Hands the verdict of the remote to the waiting Publish.
+func (r *RemotePublisher) answer(request string, verdict Message) {
+	var err error
+	if verdict.Header(OP_HEADER) == OP_DENIED {
+		err = remoteError(verdict.Header(ERROR_HEADER))
+	}
+	r.Lock()
+	defer r.Unlock()
+	if result, ok := r.requests[request]; ok {
+		//	A publish that was sent again after a reconnect may be answered
+		//	twice, the first answer counts.
+		select {
+		case result <- err:
+		default:
+		}
+	}
+}
+
+//	Removes a subscription that the remote refused. A waiting Subscribe closes
+//	the Subscriber itself, later refusals follow reconnects and close it in the
+//	background. Must be called with the lock held.
+func (r *RemotePublisher) deny(id uint64, subscription *remoteSubscription) {
+	delete(r.subscriptions, id)
+	subscription.queue.close()
+	select {
+	case <-subscription.confirmed:
+		go func() {
+			<-subscription.queue.done
+			closeSubscriber(subscription.subscriber)
+		}()
+	default:
+		subscription.denied = true
+		close(subscription.confirmed)
+	}
+}
+
+//	Returns the error the remote reported, the same value for the errors of
+//	pub, so that they can be compared.
+func remoteError(text string) error {
+	for _, known := range []error{ErrPermissionDenied, ErrPublisherClosed} {
+		if text == known.Error() {
+			return known
+		}
+	}
+	return errors.New(text)
+}
+
+//	ServeOptions configure ServePublisherWithOptions.
+type ServeOptions struct {
+	//	How many deliveries may wait for the Connection. A remote that falls
+	//	further behind is dropped: the Connection is closed and ErrSlowRemote
+	//	is returned. Zero means no limit, so a slow remote makes its deliveries
+	//	pile up in memory.
+	//
+	//	ServePublisherWithOptions sends the deliveries that are still queued
+	//	before it returns. Setting a read deadline in the past thus stops
+	//	serving without losing them, a write deadline limits how long that
+	//	takes.
+	MaxPending int
+}
+
+//	Serves the Publisher to the RemotePublisher on the other side of the
+//	Connection until the Connection fails, which is also the returned error.
+//	All subscriptions that were made by the remote are removed before
+//	ServePublisher returns. The Connection is not closed. If the remote
+//	authenticated, the sender of the messages it publishes is its
+//	authenticated identity, whatever it set itself.
+func ServePublisher(conn Connection, publisher Publisher) error {
+	return ServePublisherWithOptions(conn, publisher, ServeOptions{})
+}
+
+//	Same as ServePublisher, configured by the given options.
+func ServePublisherWithOptions(conn Connection, publisher Publisher, options ServeOptions) error {
+	server := &publisherServer{
+		conn:          conn,
+		publisher:     publisher,
+		subscriptions: make(map[string]*servedSubscription),
+	}
+	defer server.shutdown()
+	if options.MaxPending > 0 {
+		server.pending = make(chan Message, options.MaxPending)
+		server.stop = make(chan struct{})
+		server.delivered = make(chan struct{})
+		go server.deliver()
+	}
+	for {
+		request, err := conn.ReceiveMessage()
+		if err != nil {
+			if server.overflowed() {
+				return ErrSlowRemote
+			}
+			return err
+		}
+		server.handle(request)
+	}
+}
+
+type publisherServer struct {
+	conn          Connection
+	publisher     Publisher
+	subscriptions map[string]*servedSubscription
+	pending       chan Message
+	stop          chan struct{}
+	delivered     chan struct{}
+	overflow      sync.Once
+	isOverflowed  bool
+	sendLock      sync.Mutex
+	sync.Mutex
+}
+
+type servedSubscription struct {
+	pattern    string
+	subscriber Subscriber
+}
+
+func (s *publisherServer) handle(request Message) {
+	switch request.Header(OP_HEADER) {
+	case OP_PUBLISH:
+		s.answer(request, s.publisher.Publish(s.published(request)))
+	case OP_PUBLISH_RETAINED:
+		s.answer(request, s.publisher.PublishRetained(s.published(request)))
+	case OP_CLEAR_RETAINED:
+		s.publisher.ClearRetained(request.Tag())
+	case OP_SUBSCRIBE:
+		s.subscribe(request)
+	case OP_UNSUBSCRIBE:
+		id := request.Header(SUBSCRIPTION_HEADER)
+		if current, ok := s.subscriptions[id]; ok {
+			s.publisher.Unsubscribe(current.pattern, current.subscriber)
+			delete(s.subscriptions, id)
+		}
+	}
+}
+
+//	Returns the message the remote asked to publish, sent by its identity if it
+//	authenticated.
+func (s *publisherServer) published(request Message) Message {
+	result := stripControlHeaders(request)
+	if peer := s.conn.Peer(); peer.Authenticated {
+		result.SetSender(peer.Identity)
+	}
+	return result
+}
+
+//	Tells the remote whether the Publisher took the message it published.
+//	Requests without an ID don't wait for an answer.
+func (s *publisherServer) answer(request Message, err error) {
+	id := request.Header(REQUEST_HEADER)
+	if id == "" {
+		return
+	}
+	verdict := NewMessage("")
+	verdict.SetHeader(OP_HEADER, OP_PUBLISHED)
+	verdict.SetHeader(REQUEST_HEADER, id)
+	if err != nil {
+		verdict.SetHeader(OP_HEADER, OP_DENIED)
+		verdict.SetHeader(ERROR_HEADER, err.Error())
+	}
+	s.send(verdict)
+}
+
+//	Subscribes to the publisher and confirms the request, even if it is
+//	invalid, so that the remote doesn't wait for nothing. If the Publisher
+//	closed the new Subscriber right away, e.g. because an ACL denied it, the
+//	remote is told so instead.
+func (s *publisherServer) subscribe(request Message) {
+	id := request.Header(SUBSCRIPTION_HEADER)
+	if id == "" {
+		return
+	}
+	if _, ok := s.subscriptions[id]; ok {
+		s.confirm(id, OP_SUBSCRIBED)
+		return
+	}
+	bridge := &bridgeSubscriber{id: id, server: s}
+	subCreater := func() Subscriber {
+		return bridge
+	}
+	var subscriber Subscriber
+	if since := request.Header(SINCE_HEADER); since != "" {
+		timestamp, err := time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			s.confirm(id, OP_SUBSCRIBED)
+			return
+		}
+		subscriber = s.publisher.SubscribeFrom(request.Tag(), timestamp, subCreater)
+	} else {
+		subscriber = s.publisher.Subscribe(request.Tag(), subCreater)
+	}
+	if bridge.isClosed() {
+		s.publisher.Unsubscribe(request.Tag(), subscriber)
+		s.confirm(id, OP_DENIED)
+		return
+	}
+	s.subscriptions[id] = &servedSubscription{pattern: request.Tag(), subscriber: subscriber}
+	s.confirm(id, OP_SUBSCRIBED)
+}
+
+//	Answers a subscription request with OP_SUBSCRIBED or OP_DENIED.
+func (s *publisherServer) confirm(id, op string) {
+	confirmation := NewMessage("")
+	confirmation.SetHeader(OP_HEADER, op)
+	confirmation.SetHeader(SUBSCRIPTION_HEADER, id)
+	s.send(confirmation)
+}
+
+//	Removes the subscriptions of the remote and then waits until the queued
+//	deliveries are sent.
+func (s *publisherServer) shutdown() {
+	s.unsubscribeAll()
+	if s.pending != nil {
+		close(s.stop)
+		<-s.delivered
+	}
+}
+
+func (s *publisherServer) unsubscribeAll() {
+	for id, current := range s.subscriptions {
+		s.publisher.Unsubscribe(current.pattern, current.subscriber)
+		delete(s.subscriptions, id)
+	}
+}
+
+func (s *publisherServer) send(message Message) error {
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	return s.conn.SendMessage(message)
+}
+
+//	Queues a delivery for the remote. Without a limit, it is sent right away.
+//	With a limit, a full queue drops the remote.
+func (s *publisherServer) forward(delivery Message) {
+	if s.pending == nil {
+		s.send(delivery)
+		return
+	}
+	select {
+	case s.pending <- delivery:
+	default:
+		s.overflow.Do(func() {
+			s.Lock()
+			s.isOverflowed = true
+			s.Unlock()
+			s.conn.Close()
+		})
+	}
+}
+
+//	Sends the queued deliveries until ServePublisher returns, and then those
+//	that are still queued, unless the Connection fails.
+func (s *publisherServer) deliver() {
+	defer close(s.delivered)
+	for {
+		select {
+		case delivery := <-s.pending:
+			s.send(delivery)
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *publisherServer) flush() {
+	for {
+		select {
+		case delivery := <-s.pending:
+			if s.send(delivery) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (s *publisherServer) overflowed() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.isOverflowed
+}
+
+//	A bridgeSubscriber forwards the messages of a served subscription to the
+//	remote. Errors are ignored, ServePublisher notices a broken Connection on
+//	its next read.
+type bridgeSubscriber struct {
+	id     string
+	server *publisherServer
+	closed bool
+	sync.Mutex
+}
+
+func (b *bridgeSubscriber) WaitForMessage() Message {
+	return nil
+}
+
+//	Only records that the Publisher closed the subscription, see
+//	publisherServer.subscribe.
+func (b *bridgeSubscriber) Close() error {
+	b.Lock()
+	defer b.Unlock()
+	b.closed = true
+	return nil
+}
+
+func (b *bridgeSubscriber) isClosed() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.closed
+}
+
+func (b *bridgeSubscriber) Receive(message Message) {
+	payload, err := ioutil.ReadAll(message)
+	if err != nil {
+		return
+	}
+	delivery := copyMessage(message, payload)
+	delivery.SetHeader(OP_HEADER, OP_DELIVER)
+	delivery.SetHeader(SUBSCRIPTION_HEADER, b.id)
+	b.server.forward(delivery)
+}
+
+//	Returns a copy of the message without the headers that control the remote.
+func stripControlHeaders(message Message) Message {
+	payload, _ := ioutil.ReadAll(message)
+	result := newMessageWithID(message.Tag(), message.ID())
+	result.SetTimestamp(message.Timestamp())
+	result.SetSender(message.Sender())
+	for key, value := range message.Headers() {
+		if key != OP_HEADER && key != SUBSCRIPTION_HEADER && key != SINCE_HEADER && key != REQUEST_HEADER && key != ERROR_HEADER {
+			result.SetHeader(key, value)
+		}
+	}
+	result.Write(payload)
+	return result
+}
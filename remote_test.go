@@ -0,0 +1,241 @@
+package pub
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net"
+	"strings"
+	"time"
+)
+
+//	Ends with a newline, so that it comes back exactly over text connections.
+const remotePayload = "payload\n"
+
+var _ = Describe("RemotePublisher", func() {
+	var broker Publisher
+	var remote *RemotePublisher
+	var served chan error
+
+	setup := func(newConnection func(net.Conn) Connection) {
+		client, server := loopbackPair()
+		broker = New()
+		served = make(chan error, 1)
+		serverConn := newConnection(server)
+		go func() {
+			served <- ServePublisher(serverConn, broker)
+			serverConn.Close()
+		}()
+		remote = NewRemotePublisher(newConnection(client))
+	}
+
+	AfterEach(func() {
+		remote.Close()
+		Eventually(served).Should(Receive())
+		broker.Close()
+	})
+
+	for name, newConnection := range connectionTypes {
+		newConnection := newConnection
+
+		Context("over "+name+" connections", func() {
+			BeforeEach(func() {
+				setup(newConnection)
+			})
+
+			It("should publish to the remote publisher", func() {
+				sub := broker.Subscribe("orders.>", NewSubscriber)
+				message := NewMessage("orders.eu")
+				message.SetHeader("trace", "abc")
+				message.Write([]byte(remotePayload))
+				Expect(remote.Publish(message)).Should(Succeed())
+
+				result := sub.WaitForMessage()
+				Expect(result.Tag()).Should(Equal("orders.eu"))
+				Expect(result.ID()).Should(Equal(message.ID()))
+				Expect(result.Headers()).Should(Equal(map[string]string{"trace": "abc"}))
+				Expect(payloadOf(result)).Should(Equal(remotePayload))
+			})
+
+			It("should subscribe at the remote publisher", func() {
+				sub := remote.Subscribe("orders.*", NewSubscriber)
+				other := remote.Subscribe("orders.>", NewSubscriber)
+				message := NewMessage("orders.eu")
+				message.Write([]byte(remotePayload))
+				remote.Publish(message)
+
+				for _, current := range []Subscriber{sub, other} {
+					result := current.WaitForMessage()
+					Expect(result.Tag()).Should(Equal("orders.eu"))
+					Expect(result.Header(OP_HEADER)).Should(BeEmpty())
+					Expect(result.Header(SUBSCRIPTION_HEADER)).Should(BeEmpty())
+					Expect(payloadOf(result)).Should(Equal(remotePayload))
+				}
+			})
+
+			It("should deliver messages of the remote in order", func() {
+				sub := remote.Subscribe("order", newRecordingSubscriber).(*recordingSubscriber)
+				for i := 0; i < 100; i++ {
+					message := NewMessage("order")
+					message.Write([]byte{byte('a' + i%26), '\n'})
+					broker.Publish(message)
+				}
+				Eventually(sub.received).Should(HaveLen(100))
+				for i, received := range sub.received() {
+					Expect(received).Should(Equal(string([]byte{byte('a' + i%26), '\n'})))
+				}
+			})
+
+			It("should unsubscribe at the remote publisher", func() {
+				sub := remote.Subscribe("tag", newRecordingSubscriber).(*recordingSubscriber)
+				remote.Unsubscribe("tag", sub)
+				remote.Publish(NewMessage("tag"))
+				Consistently(sub.received).Should(BeEmpty())
+			})
+
+			It("should deliver retained values and history", func() {
+				message := NewMessage("config")
+				message.Write([]byte("retained\n"))
+				remote.PublishRetained(message)
+
+				sub := remote.SubscribeFrom("config", time.Time{}, NewSubscriber)
+				Expect(payloadOf(sub.WaitForMessage())).Should(Equal("retained\n"))
+
+				remote.ClearRetained("config")
+				late := remote.Subscribe("config", newRecordingSubscriber).(*recordingSubscriber)
+				Consistently(late.received).Should(BeEmpty())
+			})
+		})
+	}
+
+	Context("with an ACL", func() {
+		BeforeEach(func() {
+			acl, err := ParseACL(strings.NewReader("* all open.>"))
+			Expect(err).Should(Succeed())
+			client, server := loopbackPair()
+			broker = New()
+			served = make(chan error, 1)
+			serverConn := NewBinaryConnection(server)
+			go func() {
+				served <- ServePublisher(serverConn, NewACLPublisher(broker, acl, ""))
+				serverConn.Close()
+			}()
+			remote = NewRemotePublisher(NewBinaryConnection(client))
+		})
+
+		It("should return the denial of a publish", func() {
+			sub := broker.Subscribe(">", NewChanSubscriber).(ChanSubscriber)
+			Expect(remote.Publish(NewMessage("secret"))).Should(Equal(ErrPermissionDenied))
+			Expect(remote.PublishRetained(NewMessage("secret"))).Should(Equal(ErrPermissionDenied))
+			Expect(remote.Publish(NewMessage("open.news"))).Should(Succeed())
+			Expect((<-sub.Messages()).Tag()).Should(Equal("open.news"))
+		})
+
+		It("should close a denied subscriber", func() {
+			denied := remote.Subscribe("secret", NewSubscriber)
+			Expect(denied.WaitForMessage()).Should(BeNil())
+			allowed := remote.Subscribe("open.>", NewSubscriber)
+			broker.Publish(NewMessage("secret"))
+			broker.Publish(NewMessage("open.news"))
+			Expect(allowed.WaitForMessage().Tag()).Should(Equal("open.news"))
+		})
+	})
+
+	Context("closing", func() {
+		BeforeEach(func() {
+			setup(NewBinaryConnection)
+		})
+
+		It("should close the local subscribers", func() {
+			sub := remote.Subscribe("tag", NewSubscriber)
+			Expect(remote.Close()).Should(Succeed())
+			Expect(sub.WaitForMessage()).Should(BeNil())
+			Expect(remote.Publish(NewMessage("tag"))).Should(Equal(ErrPublisherClosed))
+			Eventually(remote.Done()).Should(BeClosed())
+		})
+
+		It("should remove the remote subscriptions when the connection ends", func() {
+			remote.Subscribe("tag", NewSubscriber)
+			remote.Publish(NewMessage("sync"))
+			remote.Close()
+			Eventually(served).Should(Receive(HaveOccurred()))
+			served <- nil
+			Expect(broker.(*publisher).queues).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("ServePublisher", func() {
+	It("should drop a remote that falls too far behind", func() {
+		client, server := loopbackPair()
+		clientConn := NewBinaryConnection(client)
+		defer clientConn.Close()
+		serverConn := NewBinaryConnection(server)
+		defer serverConn.Close()
+		broker := New()
+		defer broker.Close()
+		served := make(chan error, 1)
+		go func() {
+			served <- ServePublisherWithOptions(serverConn, broker, ServeOptions{MaxPending: 2})
+		}()
+
+		//	The remote subscribes, but never reads its deliveries.
+		request := NewMessage("flood")
+		request.SetHeader(OP_HEADER, OP_SUBSCRIBE)
+		request.SetHeader(SUBSCRIPTION_HEADER, "1")
+		Expect(clientConn.SendMessage(request)).Should(Succeed())
+		payload := make([]byte, 256*1024)
+		Eventually(func() bool {
+			message := NewMessage("flood")
+			message.Write(payload)
+			broker.Publish(message)
+			select {
+			case err := <-served:
+				Expect(err).Should(Equal(ErrSlowRemote))
+				return true
+			default:
+				return false
+			}
+		}, 5*time.Second, time.Millisecond).Should(BeTrue())
+	})
+
+	It("should send the queued deliveries before it returns", func() {
+		client, server := loopbackPair()
+		clientConn := NewBinaryConnection(client)
+		defer clientConn.Close()
+		serverConn := NewBinaryConnection(server)
+		defer serverConn.Close()
+		broker := New()
+		served := make(chan error, 1)
+		go func() {
+			served <- ServePublisherWithOptions(serverConn, broker, ServeOptions{MaxPending: 100})
+		}()
+
+		request := NewMessage("flood")
+		request.SetHeader(OP_HEADER, OP_SUBSCRIBE)
+		request.SetHeader(SUBSCRIPTION_HEADER, "1")
+		Expect(clientConn.SendMessage(request)).Should(Succeed())
+		confirmation, err := clientConn.ReceiveMessage()
+		Expect(err).Should(Succeed())
+		Expect(confirmation.Header(OP_HEADER)).Should(Equal(OP_SUBSCRIBED))
+
+		//	Far more than the socket buffers hold, so most deliveries are still
+		//	queued when serving stops.
+		payload := make([]byte, 256*1024)
+		for i := 0; i < 50; i++ {
+			message := NewMessage("flood")
+			message.Write(payload)
+			Expect(broker.Publish(message)).Should(Succeed())
+		}
+		Expect(broker.Drain(context.Background())).Should(Succeed())
+		serverConn.SetReadDeadline(time.Unix(1, 0))
+
+		clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 50; i++ {
+			delivery, err := clientConn.ReceiveMessage()
+			Expect(err).Should(Succeed())
+			Expect(delivery.Header(OP_HEADER)).Should(Equal(OP_DELIVER))
+		}
+		Eventually(served).Should(Receive(HaveOccurred()))
+	})
+})
@@ -1,24 +1,244 @@
 package pub
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//	A BackpressurePolicy decides what a Subscriber does with a new message while
+//	its buffer is full.
+type BackpressurePolicy int
+
+const (
+	//	Receive blocks until there is room in the buffer.
+	POLICY_BLOCK BackpressurePolicy = iota
+	//	The new message is dropped.
+	POLICY_DROP_NEWEST
+	//	The oldest buffered message is dropped to make room for the new one.
+	POLICY_DROP_OLDEST
+	//	Receive blocks until there is room in the buffer or the timeout expired.
+	//	In the latter case, the new message is dropped.
+	POLICY_BLOCK_WITH_TIMEOUT
+	//	The new message is dropped and ErrSubscriberFull is reported by Err.
+	POLICY_ERROR
+)
+
+const DEFAULT_SUBSCRIBER_BUFFER = 4
+
+var (
+	ErrSubscriberFull   = errors.New("subscriber buffer is full, message dropped")
+	ErrSubscriberClosed = errors.New("subscriber is closed")
+	ErrNoMessage        = errors.New("no message available")
+)
+
 type Subscriber interface {
 	WaitForMessage() Message
 	Receive(message Message)
 }
 
+//	A BufferedSubscriber buffers received messages until they are fetched with
+//	WaitForMessage. The Subscribers returned by NewSubscriber and
+//	NewSubscriberWithOptions implement it.
+type BufferedSubscriber interface {
+	Subscriber
+
+	//	Returns how many messages were dropped because the buffer was full.
+	Dropped() uint64
+
+	//	Returns and resets the last error that occured while receiving a message.
+	Err() error
+}
+
+//	A ContextSubscriber can be waited on without blocking forever. The Subscribers
+//	returned by NewSubscriber and NewSubscriberWithOptions implement it, check
+//	other Subscribers with a type assertion.
+type ContextSubscriber interface {
+	Subscriber
+
+	//	Waits for a message until the context is done. Returns the error of the
+	//	context or ErrSubscriberClosed if the Subscriber was closed and all
+	//	buffered messages were fetched.
+	WaitForMessageContext(ctx context.Context) (Message, error)
+
+	//	Returns a buffered message without waiting. Returns ErrNoMessage if there
+	//	is none or ErrSubscriberClosed if the Subscriber was closed and all
+	//	buffered messages were fetched.
+	TryWaitForMessage() (Message, error)
+
+	//	Closes the Subscriber. Messages received afterwards are discarded, buffered
+	//	messages can still be fetched. Blocked waiters are released.
+	Close() error
+}
+
+//	SubscriberOptions configure the Subscriber created by NewSubscriberWithOptions.
+type SubscriberOptions struct {
+	//	The number of messages that can be buffered. Defaults to
+	//	DEFAULT_SUBSCRIBER_BUFFER if not positive.
+	BufferSize int
+
+	//	What to do when the buffer is full. Defaults to POLICY_BLOCK.
+	Policy BackpressurePolicy
+
+	//	How long to wait for room in the buffer with POLICY_BLOCK_WITH_TIMEOUT.
+	Timeout time.Duration
+}
+
 type simpleSubscriber struct {
 	channel chan Message
+	policy  BackpressurePolicy
+	timeout time.Duration
+	dropped uint64
+	err     error
+	closed  chan struct{}
+	once    sync.Once
+	sync.Mutex
 }
 
+//	Returns a Subscriber that buffers up to DEFAULT_SUBSCRIBER_BUFFER messages
+//	and blocks when its buffer is full.
 func NewSubscriber() Subscriber {
-	channel := make(chan Message, 4)
-	return &simpleSubscriber{channel}
+	return NewSubscriberWithOptions(SubscriberOptions{})
+}
+
+//	Returns a Subscriber configured by the given options. The result implements
+//	BufferedSubscriber and ContextSubscriber. Use a closure to pass it to
+//	Publisher.Subscribe:
+//		pub.Subscribe("tag", func() Subscriber {
+//			return NewSubscriberWithOptions(options)
+//		})
+func NewSubscriberWithOptions(options SubscriberOptions) Subscriber {
+	if options.BufferSize <= 0 {
+		options.BufferSize = DEFAULT_SUBSCRIBER_BUFFER
+	}
+	channel := make(chan Message, options.BufferSize)
+	return &simpleSubscriber{
+		channel: channel,
+		policy:  options.Policy,
+		timeout: options.Timeout,
+		closed:  make(chan struct{}),
+	}
 }
 
+//	Returns the next message. Returns nil once the Subscriber is closed and all
+//	buffered messages were fetched.
 func (s *simpleSubscriber) WaitForMessage() Message {
-	result := <-s.channel
+	result, _ := s.WaitForMessageContext(context.Background())
 	return result
 }
 
+func (s *simpleSubscriber) WaitForMessageContext(ctx context.Context) (Message, error) {
+	select {
+	case result := <-s.channel:
+		return result, nil
+	default:
+	}
+	select {
+	case result := <-s.channel:
+		return result, nil
+	case <-s.closed:
+		return s.TryWaitForMessage()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *simpleSubscriber) TryWaitForMessage() (Message, error) {
+	select {
+	case result := <-s.channel:
+		return result, nil
+	default:
+	}
+	select {
+	case <-s.closed:
+		return nil, ErrSubscriberClosed
+	default:
+		return nil, ErrNoMessage
+	}
+}
+
+func (s *simpleSubscriber) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+func (s *simpleSubscriber) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *simpleSubscriber) Receive(message Message) {
-	s.channel <- message
+	if s.isClosed() {
+		return
+	}
+	switch s.policy {
+	case POLICY_DROP_NEWEST:
+		select {
+		case s.channel <- message:
+		default:
+			s.drop(nil)
+		}
+	case POLICY_DROP_OLDEST:
+		for {
+			select {
+			case s.channel <- message:
+				return
+			default:
+			}
+			select {
+			case <-s.channel:
+				s.drop(nil)
+			default:
+			}
+		}
+	case POLICY_BLOCK_WITH_TIMEOUT:
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		select {
+		case s.channel <- message:
+		case <-timer.C:
+			s.drop(nil)
+		case <-s.closed:
+		}
+	case POLICY_ERROR:
+		select {
+		case s.channel <- message:
+		default:
+			s.drop(ErrSubscriberFull)
+		}
+	default:
+		select {
+		case s.channel <- message:
+		case <-s.closed:
+		}
+	}
+}
+
+func (s *simpleSubscriber) drop(err error) {
+	atomic.AddUint64(&s.dropped, 1)
+	if err != nil {
+		s.Lock()
+		s.err = err
+		s.Unlock()
+	}
+}
+
+func (s *simpleSubscriber) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+func (s *simpleSubscriber) Err() error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.err
+	s.err = nil
+	return err
 }
@@ -1,8 +1,10 @@
 package pub
 
 import (
+	"context"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"time"
 )
 
 var _ = Describe("Subscriber", func() {
@@ -29,4 +31,125 @@ var _ = Describe("Subscriber", func() {
 			return msg.Tag()
 		}).Should(Equal(message.Tag()))
 	})
+
+	Context("backpressure", func() {
+		It("should drop the newest messages", func() {
+			sub := NewSubscriberWithOptions(SubscriberOptions{BufferSize: 2, Policy: POLICY_DROP_NEWEST})
+			fillSubscriber(sub, 5)
+			Expect(sub.(BufferedSubscriber).Dropped()).Should(Equal(uint64(3)))
+			Expect(sub.(BufferedSubscriber).Err()).Should(BeNil())
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("0"))
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("1"))
+		})
+
+		It("should drop the oldest messages", func() {
+			sub := NewSubscriberWithOptions(SubscriberOptions{BufferSize: 2, Policy: POLICY_DROP_OLDEST})
+			fillSubscriber(sub, 5)
+			Expect(sub.(BufferedSubscriber).Dropped()).Should(Equal(uint64(3)))
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("3"))
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("4"))
+		})
+
+		It("should drop messages after the timeout", func() {
+			sub := NewSubscriberWithOptions(SubscriberOptions{BufferSize: 1, Policy: POLICY_BLOCK_WITH_TIMEOUT, Timeout: 10 * time.Millisecond})
+			start := time.Now()
+			fillSubscriber(sub, 3)
+			Expect(time.Since(start)).Should(BeNumerically(">=", 20*time.Millisecond))
+			Expect(sub.(BufferedSubscriber).Dropped()).Should(Equal(uint64(2)))
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("0"))
+		})
+
+		It("should report an error", func() {
+			sub := NewSubscriberWithOptions(SubscriberOptions{BufferSize: 1, Policy: POLICY_ERROR})
+			fillSubscriber(sub, 2)
+			Expect(sub.(BufferedSubscriber).Dropped()).Should(Equal(uint64(1)))
+			Expect(sub.(BufferedSubscriber).Err()).Should(Equal(ErrSubscriberFull))
+			Expect(sub.(BufferedSubscriber).Err()).Should(BeNil())
+		})
+
+		It("should block by default", func() {
+			sub := NewSubscriber()
+			fillSubscriber(sub, DEFAULT_SUBSCRIBER_BUFFER)
+			done := make(chan struct{})
+			go func() {
+				fillSubscriber(sub, 1)
+				close(done)
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			sub.WaitForMessage()
+			Eventually(done).Should(BeClosed())
+			Expect(sub.(BufferedSubscriber).Dropped()).Should(BeZero())
+		})
+	})
+
+	Context("waiting", func() {
+		var sub ContextSubscriber
+
+		BeforeEach(func() {
+			sub = NewSubscriber().(ContextSubscriber)
+		})
+
+		It("should return a buffered message without waiting", func() {
+			_, err := sub.TryWaitForMessage()
+			Expect(err).Should(Equal(ErrNoMessage))
+			fillSubscriber(sub, 1)
+			message, err := sub.TryWaitForMessage()
+			Expect(err).Should(Succeed())
+			Expect(payloadOf(message)).Should(Equal("0"))
+		})
+
+		It("should stop waiting at the deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := sub.WaitForMessageContext(ctx)
+			Expect(err).Should(Equal(context.DeadlineExceeded))
+		})
+
+		It("should stop waiting when cancelled", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			result := make(chan error, 1)
+			go func() {
+				_, err := sub.WaitForMessageContext(ctx)
+				result <- err
+			}()
+			cancel()
+			Eventually(result).Should(Receive(Equal(context.Canceled)))
+		})
+
+		It("should release waiters when closed", func() {
+			result := make(chan error, 1)
+			go func() {
+				_, err := sub.WaitForMessageContext(context.Background())
+				result <- err
+			}()
+			Consistently(result).ShouldNot(Receive())
+			sub.Close()
+			Eventually(result).Should(Receive(Equal(ErrSubscriberClosed)))
+			Expect(sub.WaitForMessage()).Should(BeNil())
+		})
+
+		It("should return buffered messages after close", func() {
+			fillSubscriber(sub, 2)
+			sub.Close()
+			fillSubscriber(sub, 1)
+			message, err := sub.WaitForMessageContext(context.Background())
+			Expect(err).Should(Succeed())
+			Expect(payloadOf(message)).Should(Equal("0"))
+			Expect(payloadOf(sub.WaitForMessage())).Should(Equal("1"))
+			_, err = sub.TryWaitForMessage()
+			Expect(err).Should(Equal(ErrSubscriberClosed))
+		})
+
+		It("should not block receiving when closed", func() {
+			fillSubscriber(sub, DEFAULT_SUBSCRIBER_BUFFER)
+			done := make(chan struct{})
+			go func() {
+				fillSubscriber(sub, 1)
+				close(done)
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			sub.Close()
+			Eventually(done).Should(BeClosed())
+		})
+	})
 })
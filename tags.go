@@ -0,0 +1,193 @@
+package pub
+
+import (
+	"strings"
+)
+
+const (
+	SINGLE_LEVEL_WILDCARD    = "*"
+	MULTI_LEVEL_WILDCARD     = ">"
+	ALT_MULTI_LEVEL_WILDCARD = "#"
+)
+
+func splitTag(tag string) []string {
+	return strings.FieldsFunc(tag, isTagSeparator)
+}
+
+func isTagSeparator(r rune) bool {
+	return r == '.' || r == '/'
+}
+
+//	Returns true if the given tag is matched by the given pattern.
+//
+//	Tags are hierarchical: a tag like "orders.eu.created" (or "orders/eu/created")
+//	consists of the levels "orders", "eu" and "created". Both '.' and '/' separate
+//	levels and may even be mixed. Empty levels are ignored.
+//
+//	A subscription tag (the pattern) may contain wildcards that span whole levels:
+//	"*" matches exactly one arbitrary level, ">" (or its alias "#") matches one or
+//	more trailing levels and is only recognized as the last level of a pattern.
+//	A wildcard that is only part of a level ("ord*") or a multi-level wildcard
+//	that is not the last level is matched literally.
+//
+//	Examples for the pattern "orders.*.created":
+//		orders.eu.created      matches
+//		orders.eu.us.created   does not match
+//	Examples for the pattern "orders.>":
+//		orders.eu              matches
+//		orders.eu.created      matches
+//		orders                 does not match
+func MatchTag(pattern, tag string) bool {
+	return matchLevels(normalizeLevels(splitTag(pattern)), splitTag(tag))
+}
+
+func matchLevels(pattern, tag []string) bool {
+	for i, level := range pattern {
+		if level == MULTI_LEVEL_WILDCARD && i == len(pattern)-1 {
+			return len(tag) > i
+		}
+		if i >= len(tag) {
+			return false
+		}
+		if level != SINGLE_LEVEL_WILDCARD && level != tag[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(tag)
+}
+
+//	Returns true if every tag matched by other is matched by pattern as well,
+//	e.g. "orders.>" covers "orders.*.created", but "orders.*" doesn't cover
+//	"orders.>".
+func coversPattern(pattern, other string) bool {
+	return coversLevels(normalizeLevels(splitTag(pattern)), normalizeLevels(splitTag(other)))
+}
+
+func coversLevels(pattern, other []string) bool {
+	for i, level := range pattern {
+		if level == MULTI_LEVEL_WILDCARD && i == len(pattern)-1 {
+			return len(other) > i
+		}
+		if i >= len(other) {
+			return false
+		}
+		if other[i] == MULTI_LEVEL_WILDCARD && i == len(other)-1 {
+			return false
+		}
+		if level == SINGLE_LEVEL_WILDCARD {
+			continue
+		}
+		if level != other[i] {
+			return false
+		}
+	}
+	return len(pattern) == len(other)
+}
+
+//	Replaces a trailing "#" with ">", so that both spellings of the multi-level
+//	wildcard end up in the same place of the trie.
+func normalizeLevels(levels []string) []string {
+	if n := len(levels); n > 0 && levels[n-1] == ALT_MULTI_LEVEL_WILDCARD {
+		levels[n-1] = MULTI_LEVEL_WILDCARD
+	}
+	return levels
+}
+
+//	A tagTrie stores values by their (possibly wildcarded) pattern. Each level of
+//	a pattern is one node of the trie, so matching a tag only visits the branches
+//	that can possibly match instead of comparing the tag with every pattern.
+type tagTrie struct {
+	root *tagNode
+}
+
+type tagNode struct {
+	children map[string]*tagNode
+	values   []interface{}
+}
+
+func newTagTrie() *tagTrie {
+	return &tagTrie{root: newTagNode()}
+}
+
+func newTagNode() *tagNode {
+	return &tagNode{children: make(map[string]*tagNode)}
+}
+
+//	Adds the value under the given pattern.
+func (t *tagTrie) insert(pattern string, value interface{}) {
+	node := t.root
+	for _, level := range normalizeLevels(splitTag(pattern)) {
+		child, ok := node.children[level]
+		if !ok {
+			child = newTagNode()
+			node.children[level] = child
+		}
+		node = child
+	}
+	node.values = append(node.values, value)
+}
+
+//	Removes the first value under the given pattern for which found returns true.
+//	Returns the removed value or nil. Nodes that become empty are pruned.
+func (t *tagTrie) remove(pattern string, found func(value interface{}) bool) interface{} {
+	levels := normalizeLevels(splitTag(pattern))
+	path := make([]*tagNode, 0, len(levels)+1)
+	node := t.root
+	path = append(path, node)
+	for _, level := range levels {
+		child, ok := node.children[level]
+		if !ok {
+			return nil
+		}
+		node = child
+		path = append(path, node)
+	}
+
+	var removed interface{}
+	for i := range node.values {
+		if found(node.values[i]) {
+			removed = node.values[i]
+			node.values = append(node.values[:i], node.values[i+1:]...)
+			break
+		}
+	}
+	if removed == nil {
+		return nil
+	}
+
+	for i := len(levels); i > 0; i-- {
+		current := path[i]
+		if len(current.values) > 0 || len(current.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, levels[i-1])
+	}
+	return removed
+}
+
+//	Returns all values whose pattern matches the given tag. The order is stable
+//	for a given trie: values of the same pattern keep their insertion order.
+func (t *tagTrie) match(tag string) []interface{} {
+	result := make([]interface{}, 0)
+	return t.root.match(splitTag(tag), result)
+}
+
+func (n *tagNode) match(levels []string, result []interface{}) []interface{} {
+	if len(levels) == 0 {
+		return append(result, n.values...)
+	}
+	if child, ok := n.children[MULTI_LEVEL_WILDCARD]; ok {
+		result = append(result, child.values...)
+	}
+	//	A literal ">" as the last level would reach the values of the trailing
+	//	wildcard again, which were already added above.
+	if child, ok := n.children[levels[0]]; ok && (levels[0] != MULTI_LEVEL_WILDCARD || len(levels) > 1) {
+		result = child.match(levels[1:], result)
+	}
+	if levels[0] != SINGLE_LEVEL_WILDCARD {
+		if child, ok := n.children[SINGLE_LEVEL_WILDCARD]; ok {
+			result = child.match(levels[1:], result)
+		}
+	}
+	return result
+}
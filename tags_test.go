@@ -0,0 +1,125 @@
+package pub
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"math/rand"
+	"strings"
+)
+
+var _ = Describe("Tags", func() {
+	Context("matching", func() {
+		It("should match exact tags", func() {
+			Expect(MatchTag("orders.eu.created", "orders.eu.created")).Should(BeTrue())
+			Expect(MatchTag("orders.eu.created", "orders.eu")).Should(BeFalse())
+			Expect(MatchTag("orders.eu", "orders.eu.created")).Should(BeFalse())
+		})
+
+		It("should treat dots and slashes alike", func() {
+			Expect(MatchTag("orders/eu/created", "orders.eu.created")).Should(BeTrue())
+			Expect(MatchTag("orders.eu/created", "orders/eu.created")).Should(BeTrue())
+		})
+
+		It("should match a single level with *", func() {
+			Expect(MatchTag("orders.*.created", "orders.eu.created")).Should(BeTrue())
+			Expect(MatchTag("orders.*.created", "orders.eu.us.created")).Should(BeFalse())
+			Expect(MatchTag("orders.*", "orders")).Should(BeFalse())
+		})
+
+		It("should match multiple levels with > and #", func() {
+			Expect(MatchTag("orders.>", "orders.eu")).Should(BeTrue())
+			Expect(MatchTag("orders.>", "orders.eu.created")).Should(BeTrue())
+			Expect(MatchTag("orders.#", "orders.eu.created")).Should(BeTrue())
+			Expect(MatchTag("orders.>", "orders")).Should(BeFalse())
+			Expect(MatchTag(">", "orders")).Should(BeTrue())
+		})
+
+		It("should match partial and misplaced wildcards literally", func() {
+			Expect(MatchTag("ord*", "orders")).Should(BeFalse())
+			Expect(MatchTag("ord*", "ord*")).Should(BeTrue())
+			Expect(MatchTag("orders.>.created", "orders.eu.created")).Should(BeFalse())
+			Expect(MatchTag("orders.>.created", "orders.>.created")).Should(BeTrue())
+		})
+	})
+
+	Context("covering", func() {
+		It("should cover patterns that match a subset of the tags", func() {
+			Expect(coversPattern("orders.>", "orders.*.created")).Should(BeTrue())
+			Expect(coversPattern("orders.>", "orders.#")).Should(BeTrue())
+			Expect(coversPattern("orders.*", "orders.eu")).Should(BeTrue())
+			Expect(coversPattern("orders.*", "orders.*")).Should(BeTrue())
+			Expect(coversPattern(">", "orders")).Should(BeTrue())
+		})
+
+		It("should not cover patterns that match more tags", func() {
+			Expect(coversPattern("orders.*", "orders.>")).Should(BeFalse())
+			Expect(coversPattern("orders.eu", "orders.*")).Should(BeFalse())
+			Expect(coversPattern("orders.>", "orders")).Should(BeFalse())
+			Expect(coversPattern("orders.eu.>", "orders.>")).Should(BeFalse())
+			Expect(coversPattern("orders.*", "invoices.eu")).Should(BeFalse())
+		})
+	})
+
+	Context("trie", func() {
+		var trie *tagTrie
+		patterns := []string{"orders.eu.created", "orders.*.created", "orders.>", "orders.#", "*.eu.*", "orders", "orders.>.created"}
+		tags := []string{"orders.eu.created", "orders.us.created", "orders.eu", "orders", "orders.eu.us.created", "invoices.eu.paid", "orders.>.created"}
+
+		BeforeEach(func() {
+			trie = newTagTrie()
+			for _, pattern := range patterns {
+				trie.insert(pattern, pattern)
+			}
+		})
+
+		It("should agree with MatchTag", func() {
+			for _, tag := range tags {
+				expected := make([]interface{}, 0)
+				for _, pattern := range patterns {
+					if MatchTag(pattern, tag) {
+						expected = append(expected, pattern)
+					}
+				}
+				Expect(trie.match(tag)).Should(ConsistOf(expected...), tag)
+			}
+		})
+
+		It("should agree with MatchTag for random patterns and tags", func() {
+			random := rand.New(rand.NewSource(1))
+			levels := []string{"a", "b", "*", ">", "#"}
+			randomTag := func() string {
+				result := make([]string, 1+random.Intn(4))
+				for i := range result {
+					result[i] = levels[random.Intn(len(levels))]
+				}
+				return strings.Join(result, ".")
+			}
+			for round := 0; round < 200; round++ {
+				trie = newTagTrie()
+				patterns := make([]string, 5)
+				for i := range patterns {
+					patterns[i] = randomTag()
+					trie.insert(patterns[i], i)
+				}
+				for j := 0; j < 20; j++ {
+					tag := randomTag()
+					expected := make([]interface{}, 0)
+					for i, pattern := range patterns {
+						if MatchTag(pattern, tag) {
+							expected = append(expected, i)
+						}
+					}
+					Expect(trie.match(tag)).Should(ConsistOf(expected...), "%v vs %s", patterns, tag)
+				}
+			}
+		})
+
+		It("should remove values and prune nodes", func() {
+			removed := trie.remove("orders.*.created", func(value interface{}) bool { return true })
+			Expect(removed).Should(Equal("orders.*.created"))
+			Expect(trie.match("orders.us.created")).Should(ConsistOf("orders.>", "orders.#"))
+			Expect(trie.remove("orders.*.created", func(value interface{}) bool { return true })).Should(BeNil())
+			Expect(trie.root.children["orders"].children).ShouldNot(HaveKey("*"))
+		})
+	})
+})